@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/imsconnect"
+	"github.com/jguillaumes/ims-injector/internal/irm_net"
+	"github.com/jguillaumes/ims-injector/internal/simulator"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+callout acts as the external server of the synchronous callout requests that the IMS
+applications issue with ICAL calls. It retrieves the requests queued to a hold queue
+TPIPE with RESUME TPIPE and answers each one with a synchronous callout response, which
+carries the correlation token of the request, computed from a rules file. This allows
+testing the ICAL programs without the real downstream service.
+
+Usage:
+
+	ims-injector callout [options] <output file>
+
+The options are:
+
+	-i <host>      The host name or IP address of the IMS system (No default, required)
+	-p <port>      The port number of the IMS system (Default: 4200)
+	-d <datastore> The datastore name (No default, required)
+	-c <clientid>  The client ID (No default, required)
+	-tpipe <name>  The hold queue TPIPE of the OTMA destination descriptor (Default: the -c client ID)
+	-u <user>      The user name to connect to the IMS system (required if OTMA security is enabled)
+	-w <password>  The password to connect to the IMS system (required if OTMA security is enabled)
+	-t <timeout>   Time in seconds IMS Connect waits for a request to arrive (Default: 30)
+	-r <rules>     JSON file with the reply rules (Default: echo all the requests)
+	-mode <mode>   RESUME TPIPE flavor: single, singlewait, auto or noauto (Default: auto)
+	-n <count>     Maximum number of requests to answer (Default: 0, no limit)
+	-duration <d>  Stop answering requests after this time (Default: 0, no limit)
+	-f <format>    Output file format: text or jsonl (Default: text)
+	-e <ccsid>     Convert the messages to and from the given EBCDIC CCSID (Default: no conversion)
+	-ctimeout <d>  Maximum time to connect to IMS Connect, including the TLS handshake (Default: 30s)
+	-v n           Enable verbose logging (1) or very verbose tracing(2)
+
+The TLS options (-tls, -tlsca, -tlscert, -tlskey, -tlsname and -tlsmin) are the same as
+for sending transactions. The rules file has the format of the simulator one, and routes
+the requests by their first word:
+
+	{
+	  "default": {"type": "echo"},
+	  "transactions": {
+	    "GETRATE": {"type": "static", "segments": ["RATE 1.0825"], "delay": "200ms"},
+	    "BADREQ":  {"type": "error", "retcode": "0x0C", "reason": "5"}
+	  }
+	}
+
+The echo rules return the request, the static ones their segments, and the error ones
+reject the request with a NAK, sending their reason as the NAK reason code. The delay is
+applied before replying, so it can exceed the ICAL timeout on purpose. The output file
+gets the replies, with the requests as their input in the jsonl format. The exit code is
+0 if the requests were answered, 1 if the flow failed and 32 if it could not be started.
+*/
+func calloutResponder(args []string) {
+	flags := flag.NewFlagSet("callout", flag.ExitOnError)
+	conn := addConnectionFlags(flags, "`Time` in seconds IMS Connect waits for a request to arrive")
+	tpipe := flags.String("tpipe", "", "Hold queue `TPIPE` of the callout requests (default: the -c client ID)")
+	rulesFile := flags.String("r", "", "JSON `file` with the reply rules (default: echo all the requests)")
+	mode := flags.String("mode", "auto", "RESUME TPIPE `flavor`: single, singlewait, auto or noauto")
+	maxRequests := flags.Int("n", 0, "Maximum `number` of requests to answer (default: 0, no limit)")
+	duration := flags.Duration("duration", 0, "Stop answering requests after this `time` (default: 0, no limit)")
+	format := flags.String("f", FORMAT_TEXT, "Output file `format`: text or jsonl")
+	verbose := flags.Int("v", 0, "Enable verbose logging")
+
+	flags.Usage = func() {
+		w := flags.Output()
+		fmt.Fprintf(w, "Usage of %s callout: {options} output_file\n", os.Args[0])
+		fmt.Fprintln(w, "Answers the synchronous callout requests queued to a TPIPE. The available options are:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	setVerbosity(*verbose)
+
+	// The errors end with code 32, as when sending transactions
+	fail := func(format string, args ...any) {
+		log.Errorf(format, args...)
+		os.Exit(32)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(32)
+	}
+	opts, err := conn.options()
+	if err != nil {
+		fail("Invalid options: %v", err)
+	}
+	resumeMode, err := imsconnect.ParseResumeMode(*mode)
+	if err != nil {
+		fail("Invalid options: %v", err)
+	}
+	if *maxRequests < 0 || *duration < 0 {
+		fail("The number of requests and the duration can not be negative")
+	}
+	if len(strings.TrimSpace(*tpipe)) > 8 {
+		fail("The TPIPE name %s is longer than 8 characters", *tpipe)
+	}
+	rules := simulator.DefaultRules()
+	if *rulesFile != "" {
+		rules, err = simulator.LoadRules(*rulesFile)
+		if err != nil {
+			fail("Error loading rules: %v", err)
+		}
+	}
+	checkRule := func(name string, rule *simulator.Rule) {
+		if rule.Type == simulator.RULE_CALLOUT {
+			fail("Invalid %s: callout rules can only be used by the simulator", name)
+		}
+		if rule.Type == simulator.RULE_ERROR && rule.Reason > 0xFFFF {
+			fail("Invalid %s: the NAK reason code must be between 0 and 65535", name)
+		}
+	}
+	checkRule("default rule", rules.Default)
+	for key, rule := range rules.Transactions {
+		checkRule("rule for "+key, rule)
+	}
+
+	outputFile, err := os.Create(flags.Arg(0))
+	if err != nil {
+		fail("Error creating output file: %v", err)
+	}
+	defer outputFile.Close()
+	output := bufio.NewWriter(outputFile)
+	writer, err := newResultWriter(*format, output)
+	if err != nil {
+		fail("Invalid output format: %v", err)
+	}
+
+	client, err := imsconnect.NewClient(opts)
+	if err != nil {
+		fail("Error creating the IMS Connect client: %v", err)
+	}
+	defer client.Close()
+
+	// SIGINT, SIGTERM and the duration end the flow after the request being answered
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		log.Warnf("%v received, stopping", sig)
+		cancel()
+	}()
+
+	req := &imsconnect.CalloutRequest{
+		Mode:  resumeMode,
+		TPIPE: *tpipe,
+		Max:   *maxRequests,
+		Reply: func(request *imsconnect.Response) *imsconnect.CalloutReply {
+			return calloutReply(ctx, rules, request.Segments)
+		},
+	}
+	numRejected := 0
+	var writeErr error
+	queue := strings.TrimSpace(*tpipe)
+	if queue == "" {
+		queue = client.ClientID()
+	}
+	log.Infof("Answering the callout requests of TPIPE %s (%v)", queue, req.Mode)
+	count, err := client.Callout(ctx, req, func(request *imsconnect.Response, reply *imsconnect.CalloutReply) {
+		result := irm_net.Result{
+			Trancode: calloutKey(request.Segments),
+			Segments: reply.Segments,
+			ClientId: client.ClientID(),
+			Start:    request.Start,
+			Timing:   request.Timing,
+			Attempts: request.Attempts,
+			Nak:      reply.Nak,
+		}
+		result.Transaction.Iteration = 1
+		result.Transaction.Segments = request.Segments
+		result.Transaction.Text = strings.Join(request.Segments, "")
+		if reply.Nak {
+			numRejected++
+		}
+		if writeErr == nil {
+			writeErr = writer.Write(&result)
+		}
+	})
+	if writeErr == nil {
+		writeErr = output.Flush()
+	}
+	if writeErr == nil {
+		writeErr = outputFile.Close()
+	}
+	if writeErr != nil {
+		log.Errorf("Error writing the output file: %v", writeErr)
+	}
+	log.Infof("%d callout requests answered from TPIPE %s, %d rejected with a NAK", count, queue, numRejected)
+	if err != nil {
+		log.Errorf("Error answering the callout requests: %v", err)
+	}
+	if err != nil || writeErr != nil {
+		os.Exit(1)
+	}
+}
+
+// calloutKey returns the first word of a callout request, used to pick its rule
+func calloutKey(segments []string) string {
+	if len(segments) == 0 {
+		return ""
+	}
+	return strings.SplitN(strings.TrimSpace(segments[0]), " ", 2)[0]
+}
+
+// calloutReply computes the reply to a callout request using the rules, waiting for the
+// delay of the rule first. If ctx is done during the delay, the reply is sent at once.
+func calloutReply(ctx context.Context, rules *simulator.Rules, segments []string) *imsconnect.CalloutReply {
+	key := calloutKey(segments)
+	rule := rules.RuleFor(key)
+	log.Debugf("Callout request %s, %d segments, rule %s", key, len(segments), rule.Type)
+	delay := time.NewTimer(time.Duration(rule.Delay))
+	select {
+	case <-delay.C:
+	case <-ctx.Done():
+		delay.Stop()
+	}
+	switch rule.Type {
+	case simulator.RULE_ERROR:
+		return &imsconnect.CalloutReply{Nak: true, NakReason: uint16(rule.Reason)}
+	case simulator.RULE_STATIC:
+		return &imsconnect.CalloutReply{Segments: rule.Segments}
+	default:
+		return &imsconnect.CalloutReply{Segments: segments}
+	}
+}
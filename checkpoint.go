@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jguillaumes/ims-injector/internal/irm_net"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkpoint records the transactions completed successfully, one per line, so a run can be
+// resumed skipping them. Each transaction is identified by its iteration over the input file
+// and its input line number, written as "iteration:line" as soon as its result is flushed to
+// the output file, so the file is valid even if the injector dies.
+// The input lines are skipped by the feeder goroutine and recorded by the collector goroutine,
+// so they use separate maps.
+type checkpoint struct {
+	file     *os.File
+	resumed  map[checkpointEntry]bool // Completed by the runs being resumed, read only once the run starts
+	recorded map[checkpointEntry]bool // Completed by this run
+	skipped  int                      // Transactions skipped because they were already completed
+}
+
+// checkpointEntry identifies an execution of an input line
+type checkpointEntry struct {
+	iteration int
+	line      int
+}
+
+func (e checkpointEntry) String() string {
+	return fmt.Sprintf("%d:%d", e.iteration, e.line)
+}
+
+// openCheckpoint opens a checkpoint file. If resume is true, the entries already in
+// the file are loaded and kept in it. Otherwise the file is emptied.
+func openCheckpoint(fileName string, resume bool) (*checkpoint, error) {
+	c := &checkpoint{resumed: make(map[checkpointEntry]bool), recorded: make(map[checkpointEntry]bool)}
+	if resume {
+		err := c.load(fileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint file: %v", err)
+	}
+	c.file = file
+	// Write again the loaded entries, dropping any incomplete entry left by a crash
+	entries := make([]checkpointEntry, 0, len(c.resumed))
+	for entry := range c.resumed {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].iteration != entries[j].iteration {
+			return entries[i].iteration < entries[j].iteration
+		}
+		return entries[i].line < entries[j].line
+	})
+	w := bufio.NewWriter(file)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%v\n", entry)
+	}
+	err = w.Flush()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write checkpoint file: %v", err)
+	}
+	return c, nil
+}
+
+// load reads the entries of a checkpoint file. A missing file is an empty checkpoint.
+// The last entry is ignored if it is not ended by a newline, since it could be incomplete.
+func (c *checkpoint) load(fileName string) error {
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		log.Warnf("Checkpoint file %s not found, nothing to resume", fileName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint file: %v", err)
+	}
+
+	entries := strings.Split(string(data), "\n")
+	if last := entries[len(entries)-1]; last != "" {
+		log.Warnf("Ignoring incomplete checkpoint entry %q", last)
+	}
+	for n, text := range entries[:len(entries)-1] {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		entry, err := parseCheckpointEntry(text)
+		if err != nil {
+			return fmt.Errorf("invalid checkpoint entry %q in line %d", text, n+1)
+		}
+		c.resumed[entry] = true
+	}
+	log.Infof("Resuming the run: %d transactions already completed", len(c.resumed))
+	return nil
+}
+
+// parseCheckpointEntry parses an "iteration:line" checkpoint entry
+func parseCheckpointEntry(text string) (checkpointEntry, error) {
+	var entry checkpointEntry
+	iteration, line, ok := strings.Cut(text, ":")
+	if !ok {
+		return entry, fmt.Errorf("iteration:line expected")
+	}
+	var err error
+	entry.iteration, err = strconv.Atoi(iteration)
+	if err != nil {
+		return entry, err
+	}
+	entry.line, err = strconv.Atoi(line)
+	return entry, err
+}
+
+// completed checks if a transaction was completed by a previous run
+func (c *checkpoint) completed(tran *irm_net.Transaction) bool {
+	return c != nil && c.resumed[checkpointEntry{iteration: tran.Iteration, line: tran.Line}]
+}
+
+// record writes the entry of a successful transaction, if it was not recorded yet.
+// The transactions whose output was rejected with a NAK are not recorded. A conversation
+// is recorded by its first line once all its steps are successful, since it can only be
+// resumed as a whole.
+func (c *checkpoint) record(result *irm_net.Result) error {
+	if c == nil || !result.OK() || result.Nak {
+		return nil
+	}
+	entry := checkpointEntry{iteration: result.Transaction.Iteration, line: result.Transaction.Line}
+	if c.resumed[entry] || c.recorded[entry] {
+		return nil
+	}
+	c.recorded[entry] = true
+	_, err := fmt.Fprintf(c.file, "%v\n", entry)
+	return err
+}
+
+// close closes the checkpoint file. It can be called more than once.
+func (c *checkpoint) close() error {
+	if c == nil || c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// skipReader skips the transactions completed by a previous run. It reads the transactions
+// after the cyclingReader, which sets their iteration.
+type skipReader struct {
+	reader     transactionReader
+	checkpoint *checkpoint
+}
+
+func (s *skipReader) Next() (irm_net.Transaction, error) {
+	for {
+		tran, err := s.reader.Next()
+		if err != nil || !s.checkpoint.completed(&tran) {
+			return tran, err
+		}
+		s.checkpoint.skipped += max(len(tran.Steps), 1)
+		log.Tracef("Skipping line %d of iteration %d, already completed", tran.Line, tran.Iteration)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jguillaumes/ims-injector/internal/compare"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+compare compares the result files of two runs of the same transaction file, for instance
+before and after a program change, and reports the responses added, removed or changed.
+
+Usage:
+
+	ims-injector compare [options] <old results> <new results>
+
+The options are:
+
+	-key <key>     Align the results by input line (line), input text (input) or position (order)
+	               (Default: line, or order if a file is in the text format)
+	-keyre <regex> Align the results by the correlation id matched by the regex in the input text
+	               (its first group, or the whole match)
+	-mask <regex>  Ignore the text matched by the regex, like timestamps or counters. Can be repeated
+	-cols <range>  Ignore a range of columns: from-to, or segment:from-to for a single segment. Can be repeated
+	-ignore <file> Read the ignore rules from a file with "mask <regex>" and "columns <range>" lines
+	-o <format>    Report format: text or json (Default: text)
+	-out <file>    Write the report to a file (Default: standard output)
+	-v n           Enable verbose logging (1) or very verbose tracing(2)
+
+The result files can be in the text or in the jsonl format. The text format does not contain the
+input lines, so its results can only be aligned by position. The exit code is 0 if the results
+are the same, 1 if there are differences and 32 if the comparison could not be done.
+*/
+func compareResults(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	key := flags.String("key", "", "Align the results by input `line`, input text (input) or position (order) (default: line, or order for text files)")
+	keyPattern := flags.String("keyre", "", "Align the results by the correlation id matched by a `regex` in the input text")
+	var masks, columns stringList
+	flags.Var(&masks, "mask", "Ignore the text matched by a `regex` (can be repeated)")
+	flags.Var(&columns, "cols", "Ignore a `range` of columns: from-to or segment:from-to (can be repeated)")
+	ignoreFile := flags.String("ignore", "", "`File` with ignore rules (mask <regex> and columns <range> lines)")
+	format := flags.String("o", compare.FORMAT_TEXT, "Report `format`: text or json")
+	outFile := flags.String("out", "", "Report `file` (default: standard output)")
+	verbose := flags.Int("v", 0, "Enable verbose logging")
+
+	flags.Usage = func() {
+		w := flags.Output()
+		fmt.Fprintf(w, "Usage of %s compare: {options} old_results new_results\n", os.Args[0])
+		fmt.Fprintln(w, "Compares the result files of two runs. The available options are:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	setVerbosity(*verbose)
+
+	// The errors end with code 32, since 1 means the results are different
+	fail := func(format string, args ...any) {
+		log.Errorf(format, args...)
+		os.Exit(32)
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(32)
+	}
+
+	rules := &compare.Rules{}
+	for _, mask := range masks {
+		err := rules.AddMask(mask)
+		if err != nil {
+			fail("Invalid ignore rule: %v", err)
+		}
+	}
+	for _, spec := range columns {
+		err := rules.AddColumns(spec)
+		if err != nil {
+			fail("Invalid ignore rule: %v", err)
+		}
+	}
+	if *ignoreFile != "" {
+		err := rules.LoadRules(*ignoreFile)
+		if err != nil {
+			fail("Error loading ignore rules: %v", err)
+		}
+	}
+
+	oldResults, oldJSON, err := readResults(flags.Arg(0))
+	if err != nil {
+		fail("Error reading result file: %v", err)
+	}
+	newResults, newJSON, err := readResults(flags.Arg(1))
+	if err != nil {
+		fail("Error reading result file: %v", err)
+	}
+	if *key == "" {
+		*key = compare.KEY_LINE
+		if !oldJSON || !newJSON {
+			*key = compare.KEY_ORDER
+		}
+	}
+	if (*key != compare.KEY_ORDER || *keyPattern != "") && (!oldJSON || !newJSON) {
+		fail("The results of text files can only be aligned by order")
+	}
+	keyFunc, err := compare.NewKeyFunc(*key, *keyPattern)
+	if err != nil {
+		fail("Invalid key: %v", err)
+	}
+	log.Debugf("Old results: %d, new results: %d, key: %s", len(oldResults), len(newResults), *key)
+
+	report := compare.Compare(oldResults, newResults, keyFunc, rules)
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if *outFile != "" {
+		file, err = os.Create(*outFile)
+		if err != nil {
+			fail("Error creating report file: %v", err)
+		}
+		out = file
+	}
+	w := bufio.NewWriter(out)
+	err = report.Write(w, *format)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && file != nil {
+		err = file.Close()
+	}
+	if err != nil {
+		fail("Error writing the report: %v", err)
+	}
+
+	if !report.Same() {
+		os.Exit(1)
+	}
+}
+
+// readResults reads a result file. It returns true if the file is in the jsonl format.
+func readResults(fileName string) ([]compare.Record, bool, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	records, isJSON, err := compare.ReadResults(file)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return records, isJSON, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/imsconnect"
+)
+
+// connectionFlags are the options to connect to IMS Connect used by the commands that
+// hold a single session instead of sending a transaction file, like resume
+type connectionFlags struct {
+	host           *string
+	port           *int
+	datastore      *string
+	clientID       *string
+	user           *string
+	password       *string
+	timeout        *int
+	ccsid          *string
+	connectTimeout *time.Duration
+	useTLS         *bool
+	tlsCA          *string
+	tlsCert        *string
+	tlsKey         *string
+	tlsName        *string
+	tlsMin         *string
+}
+
+// addConnectionFlags defines the connection options in a flag set. The meaning of the
+// timeout depends on the command, so its description is given by the caller.
+func addConnectionFlags(flags *flag.FlagSet, timeoutUsage string) *connectionFlags {
+	return &connectionFlags{
+		host:           flags.String("i", "", "IMS system `hostname` or IP address (required)"),
+		port:           flags.Int("p", 4200, "IMS system `port` number"),
+		datastore:      flags.String("d", "", "IMS `datastore` name (required)"),
+		clientID:       flags.String("c", "", "`ClientID` for the connection (required)"),
+		user:           flags.String("u", "", "`User` name for IMS system (required if OTMA security is enabled)"),
+		password:       flags.String("w", "", "`Password` for IMS system (required if OTMA security is enabled)"),
+		timeout:        flags.Int("t", 30, timeoutUsage),
+		ccsid:          flags.String("e", "", "Convert messages to and from the EBCDIC `ccsid` instead of relying on IMS Connect"),
+		connectTimeout: flags.Duration("ctimeout", 30*time.Second, "Maximum `time` to connect to IMS Connect, including the TLS handshake (0: no limit)"),
+		useTLS:         flags.Bool("tls", false, "Connect to IMS Connect using TLS"),
+		tlsCA:          flags.String("tlsca", "", "PEM `file` with the CA certificates used to verify IMS Connect (default: system pool)"),
+		tlsCert:        flags.String("tlscert", "", "PEM `file` with the client certificate (for client authentication)"),
+		tlsKey:         flags.String("tlskey", "", "PEM `file` with the client certificate key (for client authentication)"),
+		tlsName:        flags.String("tlsname", "", "Server `name` used to verify the IMS Connect certificate (default: host name)"),
+		tlsMin:         flags.String("tlsmin", "1.2", "Minimum TLS `version` (1.0, 1.1, 1.2 or 1.3)"),
+	}
+}
+
+// options validates the connection options and builds the client options from them
+func (f *connectionFlags) options() (imsconnect.Options, error) {
+	var opts imsconnect.Options
+	switch {
+	case *f.host == "":
+		return opts, fmt.Errorf("host name or IP address is required")
+	case *f.port < 1 || *f.port > 65535:
+		return opts, fmt.Errorf("port number must be between 1 and 65535")
+	case strings.TrimSpace(*f.datastore) == "":
+		return opts, fmt.Errorf("datastore name is required")
+	case strings.TrimSpace(*f.clientID) == "":
+		return opts, fmt.Errorf("client ID is required")
+	case *f.timeout < 0 || *f.timeout > 60:
+		return opts, fmt.Errorf("timeout must be between 0 and 60 seconds")
+	case *f.connectTimeout < 0:
+		return opts, fmt.Errorf("the connection timeout can not be negative")
+	}
+
+	opts = imsconnect.Options{
+		Host:           *f.host,
+		Port:           uint16(*f.port),
+		Datastore:      *f.datastore,
+		ClientID:       *f.clientID,
+		User:           *f.user,
+		Password:       *f.password,
+		Timeout:        convert_timeout(*f.timeout),
+		ConnectTimeout: *f.connectTimeout,
+	}
+	if *f.useTLS {
+		tlsConfig, err := imsconnect.NewTLSConfig(*f.tlsCA, *f.tlsCert, *f.tlsKey, *f.tlsName, *f.tlsMin)
+		if err != nil {
+			return opts, fmt.Errorf("invalid TLS configuration: %v", err)
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	if *f.ccsid != "" {
+		cp, err := imsconnect.LookupCodepage(*f.ccsid)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CCSID: %v", err)
+		}
+		opts.Codepage = cp
+	}
+	return opts, nil
+}
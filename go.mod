@@ -5,13 +5,13 @@ go 1.23.1
 toolchain go1.24.5
 
 require (
+	github.com/jguillaumes/go-encoding v1.0.0-rc3
 	github.com/jguillaumes/go-hexdump v1.1.3
 	github.com/schollz/progressbar/v3 v3.18.0
 	github.com/sirupsen/logrus v1.9.3
 )
 
 require (
-	github.com/jguillaumes/go-encoding v1.0.0-rc3 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/sys v0.34.0 // indirect
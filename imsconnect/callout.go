@@ -0,0 +1,97 @@
+package imsconnect
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm"
+)
+
+// CalloutRequest is a RESUME TPIPE request retrieving the synchronous callout requests
+// that the IMS applications issue with ICAL calls, to answer them as the external server
+// would. The requests are queued to the TPIPE named in the OTMA destination descriptor.
+type CalloutRequest struct {
+	Mode  ResumeMode
+	TPIPE string // Hold queue TPIPE (empty for the client ID of the Client)
+	Max   int    // Maximum number of requests to answer (0: no limit)
+
+	// Reply computes the answer to each callout request. It is required.
+	Reply func(req *Response) *CalloutReply
+}
+
+// CalloutReply is the answer of the callout server to a synchronous callout request
+type CalloutReply struct {
+	Segments  []string // Response message returned to the IMS application
+	Nak       bool     // Reject the request with a NAK instead of answering it
+	NakReason uint16   // Reason code returned to the IMS application with the NAK (0: none)
+}
+
+// Callout issues a RESUME TPIPE request for the synchronous callout requests only and
+// answers each request received with the reply computed by req.Reply. The reply is sent
+// with the correlation token of the request, as a SYNRESPA message that also acknowledges
+// the request, or as a SYNRESP one if the request does not require an ACK. deliver is
+// called with each request and its reply once the reply has been sent, and the number of
+// requests answered is returned.
+//
+// The flow ends as for Resume, except that a NAK does not end it: the NAK returns an error
+// to the ICAL call instead of keeping the request in the queue.
+func (c *Client) Callout(ctx context.Context, req *CalloutRequest, deliver func(*Response, *CalloutReply)) (int, error) {
+	if req.Reply == nil {
+		return 0, fmt.Errorf("a Reply function is required to answer the callout requests")
+	}
+	resIrm := c.template
+	resIrm.Irm_f0 = resIrm.Irm_f0&^irm.IRM_F0_SYNASIN | irm.IRM_F0_SYNONLY
+	timeout := c.responseTimeout(&resIrm)
+	cp := c.opts.Codepage
+
+	return c.resumeTPIPE(ctx, &resIrm, req.Mode, req.TPIPE, req.Max, func(resp *Response, parsed *irm.Response, last bool) (bool, error) {
+		if resp.Token == nil {
+			return true, fmt.Errorf("synchronous callout request without correlation token")
+		}
+		reply := req.Reply(resp)
+		if reply == nil {
+			reply = &CalloutReply{}
+		}
+		resp.Nak = reply.Nak
+		last = last || ctx.Err() != nil
+
+		// The reply may take its time, like the real server
+		c.setDeadline(timeout)
+		timer := resIrm.Irm_timer
+		if last {
+			timer = ACK_TIMER
+			if parsed.NowaitAck() {
+				timer = irm.IRM_TIMER_NOWAIT
+			}
+		}
+		op := OP_REPLY
+		replyStart := time.Now()
+		var err error
+		if reply.Nak {
+			op = OP_NAK
+			err = write_ack(c.sess, &resIrm, true, reply.NakReason, timer, c.ackBuffer, cp)
+		} else {
+			err = write_reply(c.sess, &resIrm, resp.Token, reply.Segments, parsed.AckRequired(), timer, c.sendBuffer, cp)
+		}
+		if err == nil && last && timer != irm.IRM_TIMER_NOWAIT {
+			// The answer is a timer expiration, or an RSM if the reply is rejected
+			var answer *irm.Response
+			answer, err = read_answer(c.sess, "callout response", c.respBuffer, cp)
+			if err == nil && answer != nil && answer.RSM != nil && !timerExpired(answer.RSM) {
+				if answer.RSM.Disconnects() {
+					c.sess.Close()
+				}
+				resp.Timing.Ack = time.Since(replyStart)
+				deliver(resp, reply)
+				return true, rsmError(answer.RSM)
+			}
+		}
+		resp.Timing.Ack = time.Since(replyStart)
+		if err != nil {
+			return true, &ConnectionError{Op: op, Err: err}
+		}
+		deliver(resp, reply)
+		return last, nil
+	})
+}
@@ -0,0 +1,428 @@
+package imsconnect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	hd "github.com/jguillaumes/go-hexdump"
+	"github.com/jguillaumes/ims-injector/internal/irm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Options contains the parameters of a Client. Only Host is required.
+type Options struct {
+	Host            string        // IMS Connect host name or IP address
+	Port            uint16        // IMS Connect port
+	Datastore       string        // IMS datastore name
+	ClientID        string        // Client ID. If empty, IMS Connect generates one for each socket
+	User            string        // RACF user ID, if OTMA security is enabled
+	Password        string        // RACF password, if OTMA security is enabled
+	Group           string        // RACF group name
+	Lterm           string        // Logical terminal name
+	Timeout         time.Duration // Time IMS Connect waits for the IMS response (IRM_TIMER). 0 means the IMS Connect default
+	ConnectTimeout  time.Duration // Maximum time to open the socket, including the TLS handshake (0: no limit)
+	ResponseTimeout time.Duration // Maximum time to wait for a response. 0 means the IRM timer plus TIMEOUT_MARGIN
+	TLSConfig       *tls.Config   // If not nil, the connection uses TLS
+	Codepage        *Codepage     // If not nil, the messages are encoded into and decoded from this codepage
+	Retry           *RetryPolicy  // Reconnection and retry policy. If nil, the requests are not retried
+	CommitMode      CommitMode    // Commit mode (CM_DEFAULT: the IRM template one)
+	SyncLevel       SyncLevel     // Sync level (SYNC_DEFAULT: the IRM template one)
+	NakReason       uint16        // Reason code sent with the NAKs (0: none)
+	SendMode        SendMode      // Message type (SEND_DEFAULT: the IRM template one)
+	Ordered         bool          // Ordered delivery of the send-only messages
+	SendOnlyWait    time.Duration // Time to wait for an error after a send-only message with error return (0: DEFAULT_SENDONLY_WAIT)
+	IRM             *IRM          // IRM template for the other IRM settings (nil to use NewIRM)
+}
+
+// Time added to the IRM timer to get the default response timeout. IMS Connect answers
+// with an RSM when the IRM timer expires, so the client side timeout only expires if
+// IMS Connect itself does not answer.
+const TIMEOUT_MARGIN = 5 * time.Second
+
+// Operations reported by a ConnectionError
+const (
+	OP_CONNECT = "connect to IMS"
+	OP_SEND    = "send message to IMS"
+	OP_RECEIVE = "read response from IMS"
+	OP_ACK     = "read response from IMS ACK"
+	OP_NAK     = "read response from IMS NAK"
+	OP_REPLY   = "send callout response to IMS"
+	OP_DEALLOC = "deallocate the IMS conversation"
+)
+
+// A ConnectionError is returned when the socket to IMS Connect fails. The Client closes
+// the socket, and it is opened again by the next request.
+type ConnectionError struct {
+	Op  string // Operation that failed (OP_CONNECT, OP_SEND, OP_RECEIVE, OP_ACK, OP_NAK, OP_REPLY or OP_DEALLOC)
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.Op, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// Client sends messages to IMS Connect through a persistent socket. The socket is opened
+// by Connect or by the first request. A Client is not safe for concurrent use: use a Pool
+// to share Clients between goroutines.
+type Client struct {
+	opts        Options
+	template    irm.IRM
+	sess        *IMSconSess
+	connectTime time.Duration // Connection time to be reported by the next response
+	opened      bool          // A socket was opened and not closed by Close, so a missing socket was lost
+	sendBuffer  []byte
+	respBuffer  []byte
+	ackBuffer   []byte // Kept apart to be able to send the message again
+}
+
+// NewClient creates a Client. The host name is resolved, but the socket is not opened yet.
+func NewClient(opts Options) (*Client, error) {
+	if opts.Host == "" {
+		return nil, fmt.Errorf("the IMS Connect host is required")
+	}
+	if len(strings.TrimSpace(opts.ClientID)) > 8 {
+		return nil, fmt.Errorf("client ID %s is longer than 8 characters", opts.ClientID)
+	}
+	sess, err := NewIMSconSess(opts.Host, opts.Port, opts.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IMS connection session: %v", err)
+	}
+
+	template := irm.NewIRM()
+	if opts.IRM != nil {
+		template = opts.IRM
+	}
+	c := &Client{
+		opts:       opts,
+		template:   *template,
+		sess:       sess,
+		sendBuffer: make([]byte, 0, 64*1024),
+		respBuffer: make([]byte, 256*1024),
+		ackBuffer:  make([]byte, 0, 256),
+	}
+	c.template.Irm_timer = irm.TimerValue(opts.Timeout)
+	setField(&c.template.Irm_clientid, opts.ClientID)
+	setField(&c.template.Irm_user.Irm_imsdestid, opts.Datastore)
+	setField(&c.template.Irm_user.Irm_racf_userid, opts.User)
+	setField(&c.template.Irm_user.Irm_racf_pw, opts.Password)
+	setField(&c.template.Irm_user.Irm_racf_grpname, opts.Group)
+	setField(&c.template.Irm_user.Irm_lterm, opts.Lterm)
+	opts.CommitMode.apply(&c.template)
+	opts.SyncLevel.apply(&c.template)
+	opts.SendMode.apply(&c.template)
+	if opts.Ordered {
+		applyOrdered(&c.template, true)
+	}
+	err = checkCommit(&c.template)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// setField stores an option into an IRM field, padded to 8 characters. Empty options keep the template value.
+func setField(field *string, value string) {
+	if strings.TrimSpace(value) != "" {
+		*field = fmt.Sprintf("%-8s", value)
+	}
+}
+
+// ClientID returns the client ID sent by the Client, without padding. It is empty if
+// IMS Connect generates the client IDs.
+func (c *Client) ClientID() string {
+	return strings.TrimSpace(c.template.Irm_clientid)
+}
+
+// Connect opens the socket to IMS Connect, if it is not open yet. If the Client has a
+// retry policy, it makes up to MaxAttempts attempts.
+func (c *Client) Connect(ctx context.Context) error {
+	return c.connect(ctx, false)
+}
+
+func (c *Client) connect(ctx context.Context, retry bool) error {
+	if c.sess.conn != nil {
+		return nil
+	}
+	connectTime, err := c.opts.Retry.connect(ctx, c.sess, retry, c.opts.ConnectTimeout)
+	if err != nil {
+		return &ConnectionError{Op: OP_CONNECT, Err: err}
+	}
+	c.connectTime = connectTime
+	c.opened = true
+	return nil
+}
+
+// Close closes the socket. The Client can still be used: the socket is opened again
+// by the next request.
+func (c *Client) Close() error {
+	c.opened = false
+	return c.sess.Close()
+}
+
+// Send sends a transaction made of the given segments, and waits for its response.
+// The first segment must start with the transaction code. If there are no segments,
+// the transaction code is sent alone.
+func (c *Client) Send(ctx context.Context, tran string, segments ...string) (*Response, error) {
+	if len(segments) == 0 {
+		segments = []string{tran}
+	}
+	return c.Do(ctx, &Request{Trancode: tran, Segments: segments})
+}
+
+// Do sends a request and waits for its response, sending the ACK or NAK if IMS Connect requires it.
+// The request is sent again according to the retry policy. The socket is reopened if it was
+// lost by a previous request or if IMS Connect disconnected it, unless Request.NoReconnect is set. The send-only messages get
+// no output: Do returns once the message is written, acknowledged by IMS Connect or, for the
+// ones with error return, once the Options.SendOnlyWait time passes without an error.
+//
+// If IMS Connect answers with an error, the Response contains the RSM and the error is an
+// *RSMError. If the socket fails, the error is a *ConnectionError. The Response is nil only
+// if the request could not be built.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	segments := req.Segments
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("the message has no segments")
+	}
+	trancode := req.Trancode
+	if trancode == "" {
+		trancode = strings.SplitN(segments[0], " ", 2)[0]
+	}
+	if len(trancode) > 8 {
+		return nil, fmt.Errorf("transaction code %s is too long", trancode)
+	}
+
+	tranIrm := c.template
+	tranIrm.Irm_user.Irm_trncod = fmt.Sprintf("%-8s", trancode)
+	req.Overrides.Apply(&tranIrm)
+	if err := checkCommit(&tranIrm); err != nil {
+		return nil, err
+	}
+
+	cp := c.opts.Codepage
+	msgIrm := tranIrm
+	length, err := prepareMessage(&msgIrm, segments, c.sendBuffer, cp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare message: %v", err)
+	}
+	message := c.sendBuffer[:length]
+	if log.IsLevelEnabled(log.TraceLevel) {
+		d := hd.HexDump(message, cp.DumpCodepage())
+		log.Debugf("Prepared message for IMS:\n%s", d)
+	}
+
+	policy := c.opts.Retry
+	resp := &Response{SendOnly: isSendOnly(&tranIrm)}
+	reconnected := false
+	for {
+		resp.Attempts++
+		if c.sess.conn == nil {
+			// Not connected yet, or the connection was lost by a previous attempt or request
+			lost := c.opened
+			if lost && req.NoReconnect {
+				return resp, &ConnectionError{Op: OP_SEND, Err: fmt.Errorf("the socket of the previous requests was lost")}
+			}
+			if lost {
+				log.Infof("Client %s reconnecting to IMS Connect", c.ClientID())
+				reconnected = true
+			}
+			connectStart := time.Now()
+			err = c.connect(ctx, lost)
+			if err != nil {
+				if resp.Start.IsZero() {
+					resp.Start = connectStart // Never sent, so it starts with the connection attempt
+				}
+				return resp, err
+			}
+		}
+		resp.Start = time.Now()
+		resp.Timing = Timing{Connect: c.connectTime}
+		c.connectTime = 0 // Only accounted for the first request
+
+		err = c.exchange(ctx, &tranIrm, message, req.Nak, resp)
+		if _, ok := err.(*ConnectionError); ok {
+			c.sess.Close()
+			return resp, err
+		}
+		if err == nil {
+			return resp, nil
+		}
+
+		log.Warnf("Error received from IMS Connect: %v\n", err)
+		retries := policy.Retries(resp.RSM)
+		if rsmErr, ok := err.(*RSMError); ok && rsmErr.Disconnects() {
+			log.Infof("IMS Connect disconnected the socket of client %s (RC=%04X)", c.ClientID(), rsmErr.RSM.Retcode)
+			c.sess.Close()
+			if req.NoReconnect {
+				return resp, err
+			}
+			if reconnected && isDuplicateClient(rsmErr.RSM) {
+				// IMS Connect may not have released the client ID of the previous socket yet
+				retries = max(retries, 1)
+			}
+		}
+		if resp.Attempts > retries || sleep(ctx, policy.Delay(resp.Attempts)) != nil {
+			return resp, err
+		}
+		log.Infof("Sending transaction %s again (attempt %d)", trancode, resp.Attempts+1)
+		resp.RSM = nil
+		resp.Modname = ""
+		resp.Segments = nil
+		resp.Nak = false
+	}
+}
+
+// sendOnlyResponse handles the answer of IMS Connect to a send-only message: the ACK of a
+// message accepted by OTMA, or the RSM of a rejected one. It returns the RSM as an *RSMError.
+func (c *Client) sendOnlyResponse(n int, resp *Response) error {
+	resp.Timing.RoundTrip = time.Since(resp.Start)
+	log.Debugf("Read %d send-only response bytes.\n", n)
+	parsed, _, err := analyzeResponse(c.respBuffer[:n], c.opts.Codepage)
+	if parsed != nil {
+		resp.RSM = parsed.RSM
+	}
+	return err
+}
+
+// responseTimeout returns the client side timeout for a message sent with an IRM. It is zero
+// (no timeout) if the IMS Connect default timer is used and there is no explicit timeout.
+func (c *Client) responseTimeout(tranIrm *irm.IRM) time.Duration {
+	if c.opts.ResponseTimeout > 0 {
+		return c.opts.ResponseTimeout
+	}
+	timer := irm.TimerDuration(tranIrm.Irm_timer)
+	if timer == 0 {
+		return 0
+	}
+	return timer + TIMEOUT_MARGIN
+}
+
+// exchange sends a prepared message through the socket and receives its response, sending
+// the ACK or NAK if required. It fills resp, including the timing fields. The socket errors
+// are returned as a *ConnectionError, while the errors returned by IMS Connect are an *RSMError.
+// The socket operations are interrupted if ctx is done or the response timeout expires.
+func (c *Client) exchange(ctx context.Context, tranIrm *irm.IRM, message []byte, nak func(*Response) bool, resp *Response) (err error) {
+	cp := c.opts.Codepage
+
+	conn := c.sess.conn
+	var deadline time.Time
+	timeout := c.responseTimeout(tranIrm)
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now()) // Unblock the pending read or write
+	})
+	defer func() {
+		stop()
+		var connErr *ConnectionError
+		if !errors.As(err, &connErr) {
+			return
+		}
+		if ctx.Err() != nil {
+			connErr.Err = ctx.Err()
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			connErr.Err = fmt.Errorf("no answer from IMS Connect after %v: %w", timeout, connErr.Err)
+		}
+	}()
+
+	// Send the message to IMS
+	n, err := c.sess.conn.Write(message)
+	if err != nil {
+		return &ConnectionError{Op: OP_SEND, Err: err}
+	}
+	log.Debugf("Wrote %d tx bytes.\n", n)
+
+	switch tranIrm.Irm_user.Irm_f4 {
+	case irm.IRM_F4_SENDONLY:
+		// IMS Connect does not answer
+		resp.Timing.RoundTrip = time.Since(resp.Start)
+		return nil
+	case irm.IRM_F4_SNDONLYE:
+		// IMS Connect only answers if the message is rejected. The wait is limited by the
+		// response timeout, and no error before its end means the message was accepted.
+		wait := c.opts.SendOnlyWait
+		if wait <= 0 {
+			wait = DEFAULT_SENDONLY_WAIT
+		}
+		waitEnd := time.Now().Add(wait)
+		if !deadline.IsZero() && deadline.Before(waitEnd) {
+			waitEnd = deadline
+		}
+		conn.SetReadDeadline(waitEnd)
+		n, err = readResponse(c.sess, c.respBuffer, func() {
+			resp.Timing.FirstByte = time.Since(resp.Start)
+		})
+		if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() == nil && resp.Timing.FirstByte == 0 {
+			log.Debugf("No error returned after %v, the send-only message was accepted", time.Since(resp.Start))
+			conn.SetDeadline(time.Time{})
+			resp.Timing.RoundTrip = time.Since(resp.Start)
+			return nil
+		}
+		if err != nil {
+			return &ConnectionError{Op: OP_RECEIVE, Err: err}
+		}
+		return c.sendOnlyResponse(n, resp)
+	}
+
+	// Read the response from IMS
+	log.Debug("Waiting for response from IMS")
+	n, err = readResponse(c.sess, c.respBuffer, func() {
+		resp.Timing.FirstByte = time.Since(resp.Start)
+	})
+	if err != nil {
+		return &ConnectionError{Op: OP_RECEIVE, Err: err}
+	}
+	if resp.SendOnly {
+		return c.sendOnlyResponse(n, resp)
+	}
+	resp.Timing.RoundTrip = time.Since(resp.Start)
+	log.Debugf("Read %d tx response bytes.\n", n)
+
+	parsed, segments, resperr := analyzeResponse(c.respBuffer, cp)
+	if parsed != nil {
+		resp.RSM = parsed.RSM
+		if parsed.MOD != nil {
+			resp.Modname = parsed.MOD.Modname
+		}
+	}
+	resp.Segments = segments
+	log.Tracef("Response:\n%s\n", strings.Join(segments, "\n"))
+
+	if parsed == nil || !parsed.AckRequired() {
+		return resperr
+	}
+
+	log.Debug("ACK was requested")
+	resp.Nak = nak != nil && nak(resp)
+	op, reason := OP_ACK, uint16(0)
+	if resp.Nak {
+		op, reason = OP_NAK, c.opts.NakReason
+		log.Debugf("Rejecting the output of %s with a NAK", strings.TrimSpace(tranIrm.Irm_user.Irm_trncod))
+	}
+	ackStart := time.Now()
+	ackResp, err := send_ack(c.sess, tranIrm, resp.Nak, reason, parsed.NowaitAck(), c.ackBuffer, c.respBuffer, cp)
+	resp.Timing.Ack = time.Since(ackStart)
+	if err != nil {
+		return &ConnectionError{Op: op, Err: err}
+	}
+	// After the ACK of a CM1 output, an RSM means the transaction could not be committed
+	if resperr == nil && !resp.Nak && isCM1(tranIrm) && ackResp != nil && ackResp.RSM != nil {
+		log.Warnf("The transaction %s was not committed", strings.TrimSpace(tranIrm.Irm_user.Irm_trncod))
+		resp.RSM = ackResp.RSM
+		return rsmError(ackResp.RSM)
+	}
+	return resperr
+}
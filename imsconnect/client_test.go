@@ -0,0 +1,127 @@
+package imsconnect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/simulator"
+)
+
+// startSimulator runs an IMS Connect simulator on a free local port and returns
+// the Options of a Client connected to it
+func startSimulator(t *testing.T, rules *simulator.Rules) Options {
+	t.Helper()
+	server, err := simulator.NewServer(rules, nil, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	err = server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+
+	host, port, err := net.SplitHostPort(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Options{Host: host, Port: uint16(p), Datastore: "IMS1", Timeout: 2 * time.Second}
+}
+
+func TestClientDo(t *testing.T) {
+	rules := &simulator.Rules{
+		Default: &simulator.Rule{Type: simulator.RULE_ECHO},
+		Transactions: map[string]*simulator.Rule{
+			"STATIC": {Type: simulator.RULE_STATIC, Segments: []string{"LINE 1", "LINE 2"}},
+			"FAIL":   {Type: simulator.RULE_ERROR, Retcode: 0x0C, Reason: 0x08},
+		},
+	}
+	opts := startSimulator(t, rules)
+	codepage, err := LookupCodepage("037")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		codepage *Codepage
+		req      Request
+		want     []string
+		wantRSM  *RSM
+	}{
+		{
+			name: "echo",
+			req:  Request{Segments: []string{"IVTNO DISPLAY LAST1", "SECOND SEGMENT"}},
+			want: []string{"IVTNO DISPLAY LAST1", "SECOND SEGMENT"},
+		},
+		{
+			name:     "echo EBCDIC",
+			codepage: codepage,
+			req:      Request{Segments: []string{"IVTNO DISPLAY LAST1"}},
+			want:     []string{"IVTNO DISPLAY LAST1"},
+		},
+		{
+			name: "static",
+			req:  Request{Trancode: "STATIC", Segments: []string{"STATIC"}},
+			want: []string{"LINE 1", "LINE 2"},
+		},
+		{
+			name:    "RSM",
+			req:     Request{Trancode: "FAIL", Segments: []string{"FAIL"}},
+			wantRSM: &RSM{Retcode: 0x0C, Rsncode: 0x08},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A client ID for each socket, since the simulator releases them asynchronously
+			o := opts
+			o.ClientID = "TEST" + strconv.Itoa(i+1)
+			o.Codepage = tt.codepage
+			client, err := NewClient(o)
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			resp, err := client.Do(ctx, &tt.req)
+			if resp == nil {
+				t.Fatalf("Do returned no response: %v", err)
+			}
+			if resp.Start.IsZero() || resp.Attempts != 1 {
+				t.Errorf("Start = %v, Attempts = %d, want a start time and 1 attempt", resp.Start, resp.Attempts)
+			}
+
+			if tt.wantRSM != nil {
+				var rsmErr *RSMError
+				if !errors.As(err, &rsmErr) {
+					t.Fatalf("Do error = %v, want an *RSMError", err)
+				}
+				if resp.RSM == nil || resp.RSM.Retcode != tt.wantRSM.Retcode || resp.RSM.Rsncode != tt.wantRSM.Rsncode {
+					t.Errorf("RSM = %+v, want %+v", resp.RSM, tt.wantRSM)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+			if !reflect.DeepEqual(resp.Segments, tt.want) {
+				t.Errorf("Segments = %q, want %q", resp.Segments, tt.want)
+			}
+			if resp.Timing.Connect <= 0 || resp.Timing.RoundTrip <= 0 {
+				t.Errorf("Timing = %+v, want the connection and round trip times", resp.Timing)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package imsconnect
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jguillaumes/ims-injector/internal/irm"
+)
+
+// CommitMode is the commit mode of the interactions with IMS. The zero value keeps the
+// commit mode of the IRM template.
+type CommitMode uint8
+
+const (
+	CM_DEFAULT CommitMode = iota // IRM template value (CM0 for NewIRM)
+	CM0                          // Commit-then-send: IMS commits before sending the output
+	CM1                          // Send-then-commit: IMS commits after the output is delivered
+)
+
+// SyncLevel is the synchronization level of the interactions with IMS. The zero value
+// keeps the sync level of the IRM template.
+//
+// With sync level None, the output is not confirmed. With Confirm, IMS Connect asks the
+// client to confirm the output: for CM0 an ACK removes it from the hold queue and a NAK
+// keeps it there, while for CM1 an ACK commits the transaction and a NAK backs it out.
+// Syncpt is only valid for CM1: the sync point is coordinated by RRS, which must be
+// enabled in IMS Connect.
+type SyncLevel uint8
+
+const (
+	SYNC_DEFAULT SyncLevel = iota // IRM template value (Confirm for NewIRM)
+	SYNC_NONE                     // The output is not confirmed
+	SYNC_CONFIRM                  // The client ACKs or NAKs the output
+	SYNC_SYNCPT                   // Two-phase commit coordinated by RRS (CM1 only)
+)
+
+// ParseCommitMode converts a commit mode name (0, 1, CM0 or CM1)
+func ParseCommitMode(s string) (CommitMode, error) {
+	switch strings.ToUpper(s) {
+	case "0", "CM0":
+		return CM0, nil
+	case "1", "CM1":
+		return CM1, nil
+	default:
+		return CM_DEFAULT, fmt.Errorf("invalid commit mode %s, expected 0 or 1", s)
+	}
+}
+
+func (m CommitMode) String() string {
+	switch m {
+	case CM0:
+		return "CM0"
+	case CM1:
+		return "CM1"
+	default:
+		return "default"
+	}
+}
+
+// apply sets the commit mode flag into an IRM, unless it is the default
+func (m CommitMode) apply(i *irm.IRM) {
+	user := &i.Irm_user
+	switch m {
+	case CM0:
+		user.Irm_f2 = user.Irm_f2&^(irm.IRM_F2_CM0|irm.IRM_F2_CM1) | irm.IRM_F2_CM0
+	case CM1:
+		user.Irm_f2 = user.Irm_f2&^(irm.IRM_F2_CM0|irm.IRM_F2_CM1) | irm.IRM_F2_CM1
+	}
+}
+
+// ParseSyncLevel converts a sync level name (none, confirm or syncpt)
+func ParseSyncLevel(s string) (SyncLevel, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return SYNC_NONE, nil
+	case "confirm":
+		return SYNC_CONFIRM, nil
+	case "syncpt":
+		return SYNC_SYNCPT, nil
+	default:
+		return SYNC_DEFAULT, fmt.Errorf("invalid sync level %s, expected none, confirm or syncpt", s)
+	}
+}
+
+func (s SyncLevel) String() string {
+	switch s {
+	case SYNC_NONE:
+		return "None"
+	case SYNC_CONFIRM:
+		return "Confirm"
+	case SYNC_SYNCPT:
+		return "Syncpt"
+	default:
+		return "default"
+	}
+}
+
+// apply sets the sync level flags into an IRM, unless it is the default
+func (s SyncLevel) apply(i *irm.IRM) {
+	const mask = irm.IRM_F3_SYNCCONF | irm.IRM_F3_SYNCPTX
+	user := &i.Irm_user
+	switch s {
+	case SYNC_NONE:
+		user.Irm_f3 = user.Irm_f3&^mask | irm.IRM_F3_SYNCNONE
+	case SYNC_CONFIRM:
+		user.Irm_f3 = user.Irm_f3&^mask | irm.IRM_F3_SYNCCONF
+	case SYNC_SYNCPT:
+		user.Irm_f3 = user.Irm_f3&^mask | irm.IRM_F3_SYNCPTX
+	}
+}
+
+// isCM1 checks if an IRM sends a send-then-commit message
+func isCM1(i *irm.IRM) bool {
+	return i.Irm_user.Irm_f2&irm.IRM_F2_CM1 != 0
+}
+
+// checkCommit validates the combination of commit mode and sync level of an IRM
+func checkCommit(i *irm.IRM) error {
+	if !isCM1(i) && i.Irm_user.Irm_f3&irm.IRM_F3_SYNCPTX != 0 {
+		return fmt.Errorf("sync level Syncpt requires commit mode 1")
+	}
+	return nil
+}
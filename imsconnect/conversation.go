@@ -0,0 +1,71 @@
+package imsconnect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Deallocate ends the IMS conversation of the socket, sending a deallocate conversation
+// message (IRM_F4_DEALLOC). The conversational transactions keep their conversation open
+// between the requests sent through the same socket, until the application ends it or
+// the client deallocates it. The overrides are the ones of the conversation requests,
+// so the message reaches the same datastore. If the socket is closed there is nothing
+// to deallocate: IMS Connect ends the conversation when the socket is lost.
+//
+// If IMS Connect answers with an RSM, the error is an *RSMError. If the socket fails, the
+// error is a *ConnectionError, and the socket is closed.
+func (c *Client) Deallocate(ctx context.Context, overrides *Overrides) (err error) {
+	if c.sess.conn == nil {
+		return nil
+	}
+	cp := c.opts.Codepage
+	deallocIrm := c.template
+	overrides.Apply(&deallocIrm)
+	deallocIrm.Llll = 4 + uint32(deallocIrm.Irm_len) + 4 // IRM + EOM
+	deallocIrm.Irm_user.Irm_f4 = irm.IRM_F4_DEALLOC
+	deallocIrm.Irm_user.Irm_trncod = fmt.Sprintf("%-8s", "")
+
+	conn := c.sess.conn
+	timeout := c.responseTimeout(&deallocIrm)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now()) // Unblock the pending read or write
+	})
+	defer func() {
+		stop()
+		var connErr *ConnectionError
+		if !errors.As(err, &connErr) {
+			return
+		}
+		c.sess.Close()
+		if ctx.Err() != nil {
+			connErr.Err = ctx.Err()
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			connErr.Err = fmt.Errorf("no answer from IMS Connect after %v: %w", timeout, connErr.Err)
+		}
+	}()
+
+	log.Debugf("Deallocating the conversation of client %s", c.ClientID())
+	c.setDeadline(timeout)
+	err = write_control(c.sess, &deallocIrm, c.ackBuffer, cp)
+	if err != nil {
+		return &ConnectionError{Op: OP_DEALLOC, Err: err}
+	}
+	resp, err := read_answer(c.sess, "DEALLOC", c.respBuffer, cp)
+	if err != nil {
+		return &ConnectionError{Op: OP_DEALLOC, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+	if resp == nil || resp.RSM == nil {
+		return nil
+	}
+	if resp.RSM.Disconnects() {
+		c.sess.Close()
+	}
+	return rsmError(resp.RSM)
+}
@@ -0,0 +1,90 @@
+package imsconnect
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+type IMSconSess struct {
+	hostname  string
+	tcpAddr   net.TCPAddr
+	tlsConfig *tls.Config
+	conn      net.Conn
+}
+
+// NewIMSconSess creates a session to an IMS Connect port. If tlsConfig is not nil, the
+// connection will be secured using TLS once established.
+func NewIMSconSess(hostname string, port uint16, tlsConfig *tls.Config) (*IMSconSess, error) {
+	ips, err := net.LookupHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(ips[0])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid hostname: %s", hostname)
+	}
+	tcpaddr := &net.TCPAddr{
+		IP:   ip,
+		Port: int(port),
+	}
+	newConn := &IMSconSess{
+		hostname:  hostname,
+		tcpAddr:   *tcpaddr,
+		tlsConfig: tlsConfig,
+		conn:      nil,
+	}
+	return newConn, nil
+}
+
+func (s *IMSconSess) Connect() error {
+	return s.ConnectContext(context.Background(), 0)
+}
+
+// ConnectContext opens the connection, giving up if ctx is done or if the connection, including
+// the TLS handshake, takes more than timeout (0 means no limit).
+func (s *IMSconSess) ConnectContext(ctx context.Context, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.tcpAddr.String())
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s:%d: %v", s.tcpAddr.IP, s.tcpAddr.Port, err)
+	}
+	if s.tlsConfig == nil {
+		s.conn = conn
+		return nil
+	}
+
+	// The address has already been resolved, so the server name used to verify
+	// the certificate must be set explicitly.
+	config := s.tlsConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = s.hostname
+	}
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("TLS handshake with %s:%d failed: %v", s.tcpAddr.IP, s.tcpAddr.Port, err)
+	}
+	s.conn = tlsConn
+	return nil
+}
+
+func (s *IMSconSess) Close() error {
+	if s.conn != nil {
+		err := s.conn.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close connection: %v", err)
+		}
+		s.conn = nil
+	}
+	return nil
+}
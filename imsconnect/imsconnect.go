@@ -0,0 +1,39 @@
+// Package imsconnect is a client for IMS Connect, sending transactions to IMS using
+// the IRM messages of the HWSSMPL0/HWSSMPL1 exits over persistent sockets.
+//
+// A Client owns one socket and sends one transaction at a time:
+//
+//	client, err := imsconnect.NewClient(imsconnect.Options{Host: "mvs1", Port: 9999, Datastore: "IMS1"})
+//	...
+//	defer client.Close()
+//	resp, err := client.Send(ctx, "IVTNO", "IVTNO DISPLAY LAST1")
+//
+// A Pool shares a set of Clients between goroutines. The errors returned by IMS Connect
+// are reported as *RSMError, and the socket errors as *ConnectionError.
+package imsconnect
+
+import (
+	"github.com/jguillaumes/ims-injector/internal/codepage"
+	"github.com/jguillaumes/ims-injector/internal/irm"
+)
+
+// IRM is the IMS request message header sent before the message segments
+type IRM = irm.IRM
+
+// RSM is the request status message returned by IMS Connect when an error happens
+type RSM = irm.RSM
+
+// Codepage converts the messages to and from an EBCDIC CCSID
+type Codepage = codepage.Codepage
+
+// LookupCodepage returns the Codepage for a CCSID, specified as a number (37, 037, 1140...)
+// or as a table name (IBM-037, IBM-1140...)
+func LookupCodepage(ccsid string) (*Codepage, error) {
+	return codepage.Lookup(ccsid)
+}
+
+// NewIRM returns an IRM with the default values used by the Clients: architecture level 1,
+// persistent socket, send-receive CM0 message with sync level confirm.
+func NewIRM() *IRM {
+	return irm.NewIRM()
+}
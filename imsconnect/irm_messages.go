@@ -1,4 +1,10 @@
-package irm_net
+package imsconnect
+
+import (
+	"fmt"
+
+	"github.com/jguillaumes/ims-injector/internal/irm"
+)
 
 var IRM_messages = map[uint32]string{
 	0x0004: "Exit request error message sent to client before socket termination. The socket is disconnected for IMS.",
@@ -69,3 +75,40 @@ var IRM_reasons = map[uint32]string{
 	0x0075: "The network user ID (NETUID) is larger than 246 bytes. In the input message from the client, modify the OMSECDN field of the NETUID security data section so that it is no larger than 246 bytes.",
 	0x0076: "The network session ID (NETSID) is larger than 254 bytes. In the input message from the client, modify the OMSECAR field of the NETSID security data section so that it is no larger than 254 bytes.",
 }
+
+// An RSMError is returned when IMS Connect answers a message with a request status message
+type RSMError struct {
+	RSM     *irm.RSM
+	Message string // Description of the return code
+	Reason  string // Description of the reason code
+}
+
+func (e *RSMError) Error() string {
+	return fmt.Sprintf("error returned by IMS Connect: %s: %s (RC=%04X, RSN=%04X)", e.Message, e.Reason, e.RSM.Retcode, e.RSM.Rsncode)
+}
+
+// Disconnects checks if IMS Connect closed the socket after returning the error
+func (e *RSMError) Disconnects() bool {
+	return e.RSM.Disconnects()
+}
+
+// rsmError builds an RSMError describing the return and reason codes of an RSM
+func rsmError(rsm *irm.RSM) error {
+	errmsg, ok := IRM_messages[rsm.Retcode]
+	if !ok {
+		errmsg = "No text available"
+	}
+	var errrsn string
+	switch rsm.Retcode {
+	case 0x0010:
+		errrsn = fmt.Sprintf("OTMA reason code %04X", rsm.Rsncode)
+	case 0x0018, 0x001C:
+		errrsn = fmt.Sprintf("CSL reason code %04X", rsm.Rsncode)
+	default:
+		errrsn, ok = IRM_reasons[rsm.Rsncode]
+		if !ok {
+			errrsn = "No text available"
+		}
+	}
+	return &RSMError{RSM: rsm, Message: errmsg, Reason: errrsn}
+}
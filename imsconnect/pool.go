@@ -0,0 +1,124 @@
+package imsconnect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrPoolClosed is returned when a closed Pool is used
+var ErrPoolClosed = errors.New("the pool is closed")
+
+// Pool shares up to size Clients between goroutines. The Clients are created when they are
+// needed and kept open for the next requests. Each Client uses its own client ID, built
+// with NumberedClientID.
+type Pool struct {
+	opts    Options
+	slots   chan struct{} // One element for each Client in use
+	lock    sync.Mutex
+	idle    []*Client
+	created int
+	closed  bool
+}
+
+// NewPool creates a Pool of up to size Clients using the given options
+func NewPool(opts Options, size int) (*Pool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid pool size %d", size)
+	}
+	base := strings.TrimSpace(opts.ClientID)
+	if base != "" && len(NumberedClientID(base, size-1)) > 8 {
+		return nil, fmt.Errorf("client ID %s is too long for a pool of %d clients", base, size)
+	}
+	return &Pool{
+		opts:  opts,
+		slots: make(chan struct{}, size),
+	}, nil
+}
+
+// NumberedClientID returns the client ID used by the Client number num of a set: the base
+// client ID followed by the number, or just the base for the first Client. An empty base
+// is kept empty, so IMS Connect generates the client IDs.
+func NumberedClientID(base string, num int) string {
+	base = strings.TrimSpace(base)
+	if num == 0 || base == "" {
+		return base
+	}
+	return fmt.Sprintf("%s%d", base, num)
+}
+
+// Get takes a Client from the pool, waiting until one is available or ctx is done.
+// The Client must be returned with Put.
+func (p *Pool) Get(ctx context.Context) (*Client, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return c, nil
+	}
+	opts := p.opts
+	opts.ClientID = NumberedClientID(p.opts.ClientID, p.created)
+	c, err := NewClient(opts)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	p.created++
+	return c, nil
+}
+
+// Put returns a Client taken with Get to the pool
+func (p *Pool) Put(c *Client) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		c.Close()
+	} else {
+		p.idle = append(p.idle, c)
+	}
+	<-p.slots
+}
+
+// Send sends a transaction using a Client of the pool. See Client.Send.
+func (p *Pool) Send(ctx context.Context, tran string, segments ...string) (*Response, error) {
+	if len(segments) == 0 {
+		segments = []string{tran}
+	}
+	return p.Do(ctx, &Request{Trancode: tran, Segments: segments})
+}
+
+// Do sends a request using a Client of the pool. See Client.Do.
+func (p *Pool) Do(ctx context.Context, req *Request) (*Response, error) {
+	c, err := p.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(c)
+	return c.Do(ctx, req)
+}
+
+// Close closes the idle Clients. The Clients in use are closed when they are returned.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	var errs []error
+	for _, c := range p.idle {
+		errs = append(errs, c.Close())
+	}
+	p.idle = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,264 @@
+package imsconnect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	hd "github.com/jguillaumes/go-hexdump"
+	"github.com/jguillaumes/ims-injector/internal/codepage"
+	"github.com/jguillaumes/ims-injector/internal/irm"
+	log "github.com/sirupsen/logrus"
+)
+
+// IRM_TIMER of the ACKs and replies that end an interaction: IMS Connect waits 0.5 seconds
+// for more output before answering with a timer expiration
+const ACK_TIMER = uint8(0x1E)
+
+// send_ack prepares and sends an ACK message to IMS Connect, or a NAK if nak is true.
+// tranIrm is the IRM used to send the transaction being acknowledged. If nakReason is not
+// zero, it is sent as the NAK reason code.
+// If the nowait flag is specified it will use the IRM_NO_WAIT value for the IRM timeout
+// and will *not* wait for a response. Otherwise, it will perform a read after sending
+// the ACK and return the response, which is nil if it could not be parsed.
+func send_ack(sess *IMSconSess, tranIrm *irm.IRM, nak bool, nakReason uint16, nowait bool, sendBuffer []byte, respBuffer []byte, cp *codepage.Codepage) (*irm.Response, error) {
+	timer := ACK_TIMER
+	if nowait {
+		timer = irm.IRM_TIMER_NOWAIT
+	}
+	err := write_ack(sess, tranIrm, nak, nakReason, timer, sendBuffer, cp)
+	if err != nil {
+		return nil, err
+	}
+	if nowait {
+		return nil, nil
+	}
+	return read_answer(sess, "ACK", respBuffer, cp)
+}
+
+// read_answer reads the answer of IMS Connect to an ACK, NAK or callout response (what),
+// returning nil if it could not be parsed
+func read_answer(sess *IMSconSess, what string, respBuffer []byte, cp *codepage.Codepage) (*irm.Response, error) {
+	n, err := readResponse(sess, respBuffer, nil)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Read %d %s response bytes.\n", n, what)
+	if log.IsLevelEnabled(log.TraceLevel) {
+		d := hd.HexDump(respBuffer[:n], cp.DumpCodepage())
+		log.Tracef("Response to %s:\n%s", what, d)
+	}
+	resp, err := irm.DeserializeResponse(respBuffer[:n], cp)
+	if err != nil {
+		log.Warnf("Invalid response to %s: %v", what, err)
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// write_ack sends an ACK, or a NAK if nak is true, for the output received after sending
+// tranIrm. The timer is the time IMS Connect waits for more output (IRM_TIMER_NOWAIT to
+// send it with the NOWAIT option). It does not read the response.
+func write_ack(sess *IMSconSess, tranIrm *irm.IRM, nak bool, nakReason uint16, timer uint8, sendBuffer []byte, cp *codepage.Codepage) error {
+	irm_ack := *tranIrm
+	irm_ack.Llll = 4 + uint32(irm_ack.Irm_len) + 4 // IRM + EOM
+	irm_ack.Irm_user.Irm_f4 = irm.IRM_F4_ACK
+	if nak {
+		irm_ack.Irm_user.Irm_f4 = irm.IRM_F4_NACK
+		if nakReason != 0 {
+			irm_ack.Irm_f0 |= irm.IRM_F0_NAKRSN
+			irm_ack.Irm_nak_rsncode = nakReason
+		}
+	}
+	irm_ack.Irm_timer = timer
+	if timer == irm.IRM_TIMER_NOWAIT {
+		irm_ack.Irm_user.Irm_f1 |= irm.IRM_F1_NOWAIT
+	}
+	return write_control(sess, &irm_ack, sendBuffer, cp)
+}
+
+// write_control sends a message made of an IRM without data segments, like an ACK or a
+// conversation deallocation. The IRM length must already include the EOM block.
+func write_control(sess *IMSconSess, ctlIrm *irm.IRM, sendBuffer []byte, cp *codepage.Codepage) error {
+	wbuff := bytes.NewBuffer(sendBuffer)
+	err := ctlIrm.Serialize(wbuff, cp)
+	if err != nil {
+		return err
+	}
+	// Add the EOM block
+	wbuff.WriteByte(0)
+	wbuff.WriteByte(0b00000100)
+	wbuff.WriteByte(0)
+	wbuff.WriteByte(0)
+
+	log.Debugf("Sending %c to IMS: ", ctlIrm.Irm_user.Irm_f4)
+	n, err := sess.conn.Write(sendBuffer[:ctlIrm.Llll])
+	if err != nil {
+		return err
+	}
+	log.Debugf("Wrote %d control bytes.\n", n)
+	return nil
+}
+
+// write_reply sends the response to a synchronous callout request, identified by its
+// correlation token, using an architecture level 2 IRM built from tranIrm. If ack is true,
+// the message type is SYNRESPA, which also acknowledges the request. The timer is the time
+// IMS Connect waits for the next request, as for write_ack. It does not read the answer.
+func write_reply(sess *IMSconSess, tranIrm *irm.IRM, token []byte, segments []string, ack bool, timer uint8, sendBuffer []byte, cp *codepage.Codepage) error {
+	irm_resp := *tranIrm
+	irm_resp.Irm_arch = irm.IRM_ARCH_LVL2
+	irm_resp.Irm_len = irm.IRM_COMMON_LEN + irm.IRM_USER_LEN + irm.IRM_CT_LEN
+	irm_resp.Llll = 4 + uint32(irm_resp.Irm_len)
+	irm_resp.Irm_corr_token = token
+	irm_resp.Irm_f5 = 0
+	irm_resp.Irm_user.Irm_f4 = irm.IRM_F4_SYNRESP
+	if ack {
+		irm_resp.Irm_user.Irm_f4 = irm.IRM_F4_SYNRESPA
+	}
+	irm_resp.Irm_timer = timer
+	if timer == irm.IRM_TIMER_NOWAIT {
+		irm_resp.Irm_user.Irm_f1 |= irm.IRM_F1_NOWAIT
+	}
+	length, err := prepareMessage(&irm_resp, segments, sendBuffer, cp)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Sending %c to IMS: ", irm_resp.Irm_user.Irm_f4)
+	n, err := sess.conn.Write(sendBuffer[:length])
+	if err != nil {
+		return err
+	}
+	log.Debugf("Wrote %d callout response bytes.\n", n)
+	return nil
+}
+
+// readResponse reads a complete response into buf, using its LLLL field, and returns its length.
+// If firstByte is not nil, it is called as soon as the first bytes are received. The end of the
+// connection is reported as an error, so the buffer contents are never used in that case.
+func readResponse(sess *IMSconSess, buf []byte, firstByte func()) (int, error) {
+	n, err := io.ReadAtLeast(sess.conn, buf, 4)
+	if err == io.EOF {
+		return 0, fmt.Errorf("connection closed by IMS Connect")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if firstByte != nil {
+		firstByte()
+	}
+	llll := int(binary.BigEndian.Uint32(buf[:4]))
+	if llll < 4 || llll > len(buf) {
+		return 0, fmt.Errorf("invalid response length %d", llll)
+	}
+	if llll > n {
+		_, err := io.ReadAtLeast(sess.conn, buf[n:], llll-n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("connection closed by IMS Connect in the middle of a response")
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return llll, nil
+}
+
+// isDuplicateClient checks if the RSM reports the client ID is in use by another socket
+func isDuplicateClient(rsm *irm.RSM) bool {
+	return rsm.Retcode == 0x0008 && rsm.Rsncode == 0x0038
+}
+
+// prepareMessage prepares a message to be sent to IMS Connect.
+// The message is built serializing the irm block and adding one LLZZ segment for
+// each element of segments. The first segment must start with the transaction code.
+// The message to be sent is built in the buf byte slice. The segments and the IRM
+// character fields are encoded using the cp codepage (nil means no conversion).
+func prepareMessage(irm *irm.IRM, segments []string, buf []byte, cp *codepage.Codepage) (int, error) {
+	// Total length = IRM length + (4 bytes for the llzz + segment length) for each segment + 4 bytes for EOM
+	datalen := 0
+	encoded := make([][]byte, 0, len(segments))
+	for n, segment := range segments {
+		data, err := cp.Encode(segment)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode segment %d: %v", n+1, err)
+		}
+		if len(data) == 0 {
+			return 0, fmt.Errorf("segment %d is empty", n+1)
+		}
+		if len(data)+4 > 0x7FFF {
+			return 0, fmt.Errorf("segment %d too long: %d bytes", n+1, len(data))
+		}
+		encoded = append(encoded, data)
+		datalen += len(data) + 4
+	}
+	if datalen+int(irm.Llll+4) > cap(buf) {
+		return 0, fmt.Errorf("message too long for buffer. %d bytes required, %d bytes available", datalen+int(irm.Llll+4), cap(buf))
+	}
+
+	wbuff := bytes.NewBuffer(buf)
+
+	// Set the length of the message in the IRM template
+	irm.Llll = irm.Llll + uint32(datalen+4)
+	// Serialize the IRM into the buffer
+	err := irm.Serialize(wbuff, cp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to serialize IRM: %v", err)
+	}
+
+	for _, data := range encoded {
+		// Prepare the segment length and zz bytes
+		msglen := len(data) + 4
+		msglen_be := make([]byte, 2)
+		binary.BigEndian.PutUint16(msglen_be, uint16(msglen))
+		// Write the segment length and zz bytes to the buffer
+		wbuff.Write(msglen_be)
+		wbuff.WriteByte(0) // zz byte, must be 0
+		wbuff.WriteByte(0) // zz byte, must be 0
+
+		// Copy the segment into the buffer
+		wbuff.Write(data)
+	}
+
+	// Add the EOM block
+	wbuff.WriteByte(0)
+	wbuff.WriteByte(0b00000100)
+	wbuff.WriteByte(0)
+	wbuff.WriteByte(0)
+
+	return wbuff.Len(), nil
+}
+
+// analyzeResponse parses an IMS Connect response buffer
+// If the buffer corresponds to a transaction response, it builds a slice of strings,
+// one element for response segment. Notice the results are undefined if the response
+// contains non-text elements. If cp is not nil, the segments are decoded from that codepage.
+// The deserialized response is also returned, to allow checking if an ACK is required and
+// if the NOWAIT function is available. It is nil if the buffer could not be parsed.
+func analyzeResponse(buffer []byte, cp *codepage.Codepage) (*irm.Response, []string, error) {
+	resp, err := irm.DeserializeResponse(buffer, cp)
+	if err != nil {
+		log.Errorf("inconsistent response received: %v", err)
+		if log.IsLevelEnabled(log.DebugLevel) {
+			log.Debug(hd.HexDump(buffer[:min(len(buffer), 1024)], cp.DumpCodepage()))
+		}
+		return nil, nil, fmt.Errorf("invalid response from IMS Connect: %v", err)
+	}
+
+	if resp.MOD != nil {
+		// MODNAME present in transaction response. Log it
+		log.Infof("Modname present in response: %-8s", resp.MOD.Modname)
+	}
+
+	var response = make([]string, 0, len(resp.Segments))
+	for _, seg := range resp.Segments {
+		// Actual transaction response data
+		response_line := cp.Decode(seg.Data)
+		response = append(response, response_line)
+		log.Tracef("Response line received: %s", response_line)
+	}
+
+	if resp.RSM != nil {
+		err = rsmError(resp.RSM)
+	}
+	return resp, response, err
+}
@@ -0,0 +1,102 @@
+package imsconnect
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm"
+)
+
+// Request is a message to be sent to IMS
+type Request struct {
+	Trancode  string     // Transaction code. If empty, the first word of the first segment is used
+	Segments  []string   // Message segments. The first one must start with the transaction code
+	Overrides *Overrides // IRM values for this request only (nil to use the Client ones)
+
+	// Nak is called when IMS Connect asks to confirm the output. If it returns true, the output
+	// is rejected with a NAK instead of being accepted with an ACK. If nil, all the outputs are ACKed.
+	Nak func(resp *Response) bool
+
+	// NoReconnect keeps the request on the socket of the previous requests, like the steps of a
+	// conversation after the first one, which are lost with their socket. The socket is not
+	// reopened to send the request, and it is not sent again after IMS Connect disconnects it.
+	NoReconnect bool
+}
+
+// Response is the outcome of a request. It is returned, along with the error, even when
+// the request fails, so the timing of the failed requests is also available.
+type Response struct {
+	Segments []string  // Response segments
+	Modname  string    // MOD name, if returned by IMS
+	RSM      *RSM      // Request status message, if returned by IMS Connect
+	Start    time.Time // Time the message was sent (the last time, if it was retried), or the connection attempted
+	Timing   Timing    // Time spent in each phase of the interaction, for the last attempt
+	Attempts int       // Number of times the message was sent
+	Nak      bool      // The output was rejected with a NAK
+	SendOnly bool      // The message was sent as send-only, so it has no output
+	Token    []byte    // Correlation token of a synchronous callout request
+}
+
+// Overrides contains IRM values to be used for a single transaction instead of the
+// ones in the IRM template. Empty strings and nil pointers keep the template values.
+type Overrides struct {
+	Lterm      string
+	User       string
+	Password   string
+	Group      string
+	Datastore  string
+	Timeout    *time.Duration // Time IMS Connect waits for the IMS response (IRM_TIMER)
+	RequestMod *bool          // Request the MFS MOD name (IRM_F1_MFSREQ)
+	CommitMode CommitMode     // CM_DEFAULT keeps the template value
+	SyncLevel  SyncLevel      // SYNC_DEFAULT keeps the template value
+	SendMode   SendMode       // SEND_DEFAULT keeps the template value
+	Ordered    *bool          // Ordered delivery of the send-only messages (IRM_F3_ORDER)
+}
+
+// Timing contains the durations of the phases of an interaction. The durations of
+// the phases that did not happen are zero.
+type Timing struct {
+	Connect   time.Duration // Connection to IMS Connect, for the first transaction sent through a socket
+	FirstByte time.Duration // From sending the message to receiving the first bytes of the response
+	RoundTrip time.Duration // From sending the message to receiving the complete response
+	Ack       time.Duration // Sending the ACK or NAK and, if not NOWAIT, receiving its response
+}
+
+// Apply sets the override values into an IRM. It does nothing if o is nil.
+func (o *Overrides) Apply(i *irm.IRM) {
+	if o == nil {
+		return
+	}
+	user := &i.Irm_user
+	if o.Lterm != "" {
+		user.Irm_lterm = fmt.Sprintf("%-8s", o.Lterm)
+	}
+	if o.User != "" {
+		user.Irm_racf_userid = fmt.Sprintf("%-8s", o.User)
+	}
+	if o.Password != "" {
+		user.Irm_racf_pw = fmt.Sprintf("%-8s", o.Password)
+	}
+	if o.Group != "" {
+		user.Irm_racf_grpname = fmt.Sprintf("%-8s", o.Group)
+	}
+	if o.Datastore != "" {
+		user.Irm_imsdestid = fmt.Sprintf("%-8s", o.Datastore)
+	}
+	if o.Timeout != nil {
+		i.Irm_timer = irm.TimerValue(*o.Timeout)
+	}
+	if o.RequestMod != nil {
+		if *o.RequestMod {
+			user.Irm_f1 |= irm.IRM_F1_MFSREQ
+		} else {
+			user.Irm_f1 &^= irm.IRM_F1_MFSREQ
+		}
+	}
+	o.CommitMode.apply(i)
+	o.SyncLevel.apply(i)
+	o.SendMode.apply(i)
+	if o.Ordered != nil {
+		applyOrdered(i, *o.Ordered)
+	}
+}
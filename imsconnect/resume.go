@@ -0,0 +1,257 @@
+package imsconnect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm"
+	log "github.com/sirupsen/logrus"
+)
+
+// ResumeMode is the flavor of a RESUME TPIPE request, which retrieves the asynchronous
+// output queued by OTMA to the TPIPE of a client ID, like the messages inserted by the
+// IMS applications to an alternate PCB.
+type ResumeMode uint8
+
+const (
+	RESUME_SINGLE      ResumeMode = iota // Retrieve a single message
+	RESUME_SINGLE_WAIT                   // Retrieve a single message, waiting for it to arrive
+	RESUME_AUTO                          // Retrieve the queued messages and the new ones as they arrive
+	RESUME_NOAUTO                        // Retrieve the messages already queued
+)
+
+// ParseResumeMode converts a RESUME TPIPE flavor name (single, singlewait, auto or noauto)
+func ParseResumeMode(s string) (ResumeMode, error) {
+	switch strings.ToLower(s) {
+	case "single":
+		return RESUME_SINGLE, nil
+	case "singlewait":
+		return RESUME_SINGLE_WAIT, nil
+	case "auto":
+		return RESUME_AUTO, nil
+	case "noauto":
+		return RESUME_NOAUTO, nil
+	default:
+		return RESUME_SINGLE, fmt.Errorf("invalid RESUME TPIPE mode %s, expected single, singlewait, auto or noauto", s)
+	}
+}
+
+func (m ResumeMode) String() string {
+	switch m {
+	case RESUME_SINGLE:
+		return "single"
+	case RESUME_SINGLE_WAIT:
+		return "singlewait"
+	case RESUME_AUTO:
+		return "auto"
+	case RESUME_NOAUTO:
+		return "noauto"
+	default:
+		return fmt.Sprintf("mode %d", m)
+	}
+}
+
+// flag returns the IRM_F5 value of the flavor
+func (m ResumeMode) flag() uint8 {
+	switch m {
+	case RESUME_SINGLE_WAIT:
+		return irm.IRM_F5_SNGLWT
+	case RESUME_AUTO:
+		return irm.IRM_F5_AUTO
+	case RESUME_NOAUTO:
+		return irm.IRM_F5_NOAUTO
+	default:
+		return irm.IRM_F5_ONEMSG
+	}
+}
+
+// single checks if the flavor retrieves a single message
+func (m ResumeMode) single() bool {
+	return m == RESUME_SINGLE || m == RESUME_SINGLE_WAIT
+}
+
+// ResumeRequest is a RESUME TPIPE request
+type ResumeRequest struct {
+	Mode  ResumeMode
+	TPIPE string // Alternate client ID whose TPIPE is resumed (empty for the client ID of the Client)
+	Max   int    // Maximum number of messages to retrieve (0: no limit)
+
+	// Nak is called for each message retrieved. If it returns true, the message is rejected
+	// with a NAK, so it stays in the queue, and the retrieval ends. If nil, all the messages
+	// are ACKed, which removes them from the queue.
+	Nak func(resp *Response) bool
+}
+
+// Resume issues a RESUME TPIPE request and calls deliver with each message retrieved, once
+// it has been ACKed or NAKed. It returns the number of messages retrieved. The Client must
+// have a client ID, and the IRM timer of the Client is the time IMS Connect waits for a
+// message to arrive.
+//
+// The retrieval ends when IMS Connect reports there are no more messages (the IRM timer
+// expires), after retrieving a single message or req.Max messages, after a NAK, or when ctx
+// is done. A single message is acknowledged as the output of a transaction. The socket is
+// closed at the end of the auto and noauto flows, since IMS Connect keeps sending messages:
+// the message it may have sent after the last ACK is not acknowledged, so it stays queued.
+func (c *Client) Resume(ctx context.Context, req *ResumeRequest, deliver func(*Response)) (int, error) {
+	resIrm := c.template
+	resIrm.Irm_f0 &^= irm.IRM_F0_SYNONLY | irm.IRM_F0_SYNASIN
+	return c.resumeTPIPE(ctx, &resIrm, req.Mode, req.TPIPE, req.Max, func(resp *Response, parsed *irm.Response, last bool) (bool, error) {
+		if !parsed.AckRequired() {
+			deliver(resp)
+			return last, nil
+		}
+		resp.Nak = req.Nak != nil && req.Nak(resp)
+		last = last || resp.Nak
+		op, reason := OP_ACK, uint16(0)
+		if resp.Nak {
+			op, reason = OP_NAK, c.opts.NakReason
+		}
+		ackStart := time.Now()
+		var err error
+		if last {
+			_, err = send_ack(c.sess, &resIrm, resp.Nak, reason, parsed.NowaitAck(), c.ackBuffer, c.respBuffer, c.opts.Codepage)
+		} else {
+			// The answer to the ACK is the next message
+			err = write_ack(c.sess, &resIrm, false, 0, resIrm.Irm_timer, c.ackBuffer, c.opts.Codepage)
+		}
+		resp.Timing.Ack = time.Since(ackStart)
+		if err != nil {
+			return true, &ConnectionError{Op: op, Err: err}
+		}
+		deliver(resp)
+		return last, nil
+	})
+}
+
+// resumeTPIPE sends the RESUME TPIPE request built from resIrm and calls answer with each
+// message received, which must send its ACK, NAK or reply. last tells if the message is
+// the last one to be retrieved, and answer returns if the flow ends with it. answer is
+// called with the session deadline already set.
+func (c *Client) resumeTPIPE(ctx context.Context, resIrm *irm.IRM, mode ResumeMode, tpipe string, max int, answer func(resp *Response, parsed *irm.Response, last bool) (bool, error)) (count int, err error) {
+	if c.ClientID() == "" {
+		return 0, fmt.Errorf("RESUME TPIPE requires a client ID")
+	}
+	if len(strings.TrimSpace(tpipe)) > 8 {
+		return 0, fmt.Errorf("TPIPE %s is longer than 8 characters", tpipe)
+	}
+	err = c.connect(ctx, c.opened)
+	if err != nil {
+		return 0, err
+	}
+	cp := c.opts.Codepage
+
+	resIrm.Irm_f5 = mode.flag()
+	resIrm.Irm_user.Irm_f4 = irm.IRM_F4_RESUMET
+	resIrm.Irm_user.Irm_trncod = "        "
+	setField(&resIrm.Irm_user.Irm_rt_altcid, tpipe)
+	msgIrm := *resIrm
+	length, err := prepareMessage(&msgIrm, nil, c.sendBuffer, cp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare RESUME TPIPE: %v", err)
+	}
+
+	conn := c.sess.conn
+	timeout := c.responseTimeout(resIrm)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now()) // Unblock the pending read or write
+	})
+	defer func() {
+		stop()
+		var connErr *ConnectionError
+		if !errors.As(err, &connErr) {
+			return
+		}
+		c.sess.Close()
+		if ctx.Err() != nil {
+			// Interrupted while waiting for a message, which is not an error
+			err = nil
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			connErr.Err = fmt.Errorf("no answer from IMS Connect after %v: %w", timeout, connErr.Err)
+		}
+	}()
+
+	tpipe = strings.TrimSpace(tpipe)
+	if tpipe == "" {
+		tpipe = c.ClientID()
+	}
+	log.Debugf("Resuming TPIPE %s (%v)", tpipe, mode)
+	start := time.Now()
+	c.setDeadline(timeout)
+	_, err = conn.Write(c.sendBuffer[:length])
+	if err != nil {
+		return 0, &ConnectionError{Op: OP_SEND, Err: err}
+	}
+
+	for {
+		resp := &Response{Start: start, Attempts: 1}
+		n, err := readResponse(c.sess, c.respBuffer, func() {
+			resp.Timing.FirstByte = time.Since(start)
+		})
+		if err != nil {
+			return count, &ConnectionError{Op: OP_RECEIVE, Err: err}
+		}
+		resp.Timing.RoundTrip = time.Since(start)
+		log.Debugf("Read %d RESUME TPIPE response bytes.\n", n)
+
+		parsed, segments, resperr := analyzeResponse(c.respBuffer, cp)
+		if parsed != nil {
+			resp.RSM = parsed.RSM
+			if parsed.MOD != nil {
+				resp.Modname = parsed.MOD.Modname
+			}
+			if parsed.CT != nil {
+				resp.Token = parsed.CT.Token
+			}
+		}
+		if resperr != nil {
+			if resp.RSM != nil && resp.RSM.Disconnects() {
+				c.sess.Close()
+			}
+			if resp.RSM != nil && timerExpired(resp.RSM) {
+				log.Debugf("No more messages in the TPIPE after %d messages", count)
+				return count, nil
+			}
+			return count, resperr
+		}
+		resp.Segments = segments
+		count++
+
+		last := mode.single() || (max > 0 && count >= max) || ctx.Err() != nil
+		c.setDeadline(timeout)
+		last, err = answer(resp, parsed, last)
+		if err != nil {
+			return count, err
+		}
+		if last {
+			if !mode.single() {
+				c.sess.Close()
+			}
+			return count, nil
+		}
+		start = time.Now()
+		c.setDeadline(timeout)
+	}
+}
+
+// setDeadline sets the deadline of the next reads and writes of the session, timeout from
+// now (no deadline if timeout is zero)
+func (c *Client) setDeadline(timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	c.sess.conn.SetDeadline(deadline)
+}
+
+// timerExpired checks if the RSM reports the expiration of the IRM timer
+func timerExpired(rsm *RSM) bool {
+	switch rsm.Retcode {
+	case 0x0020, 0x0024, 0x0028:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package imsconnect
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default random variation of the backoff delays (+/- 20%)
+const DEFAULT_JITTER = 0.2
+
+// RetryPolicy controls how a worker recovers from errors. A nil policy means no
+// reconnection and no retries: the worker ends after a connection error.
+type RetryPolicy struct {
+	MaxAttempts int           // Connection attempts before giving up (0 or 1: no reconnection)
+	Backoff     time.Duration // Delay before the first reconnection or retry. It is doubled on each attempt
+	MaxBackoff  time.Duration // Maximum delay between attempts (0: no limit)
+	Jitter      float64       // Random variation of the delays, as a fraction of them
+	Rules       []RetryRule   // Transaction retry rules
+}
+
+// RetryRule specifies a transaction must be sent again when IMS Connect answers it with
+// an RSM with the given return code (and reason code, unless AnyReason is true).
+type RetryRule struct {
+	Retcode   uint32
+	Rsncode   uint32
+	AnyReason bool
+	Retries   int // Maximum number of times the transaction is sent again
+}
+
+// ParseRetryRules parses a comma separated list of RC[/RSN][:retries] rules, with the codes in
+// hexadecimal. For instance, "20:3,8/38" retries three times the transactions that get an
+// IRM_TIMER expiration (RC=20), and once the ones that get a duplicate client ID (RC=8, RSN=38).
+func ParseRetryRules(spec string) ([]RetryRule, error) {
+	var rules []RetryRule
+	if strings.TrimSpace(spec) == "" {
+		return rules, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		rule := RetryRule{Retries: 1, AnyReason: true}
+		codes, retries, found := strings.Cut(item, ":")
+		if found {
+			n, err := strconv.Atoi(retries)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid number of retries in rule %q", item)
+			}
+			rule.Retries = n
+		}
+		retcode, rsncode, found := strings.Cut(codes, "/")
+		rc, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(retcode), "0x"), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid return code in rule %q", item)
+		}
+		rule.Retcode = uint32(rc)
+		if found {
+			rsn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(rsncode), "0x"), 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid reason code in rule %q", item)
+			}
+			rule.Rsncode = uint32(rsn)
+			rule.AnyReason = false
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Retries returns the number of times a transaction answered with rsm can be sent again.
+// It returns 0 if there is no RSM or no rule matches it.
+func (p *RetryPolicy) Retries(rsm *irm.RSM) int {
+	if p == nil || rsm == nil {
+		return 0
+	}
+	for _, rule := range p.Rules {
+		if rule.Retcode == rsm.Retcode && (rule.AnyReason || rule.Rsncode == rsm.Rsncode) {
+			return rule.Retries
+		}
+	}
+	return 0
+}
+
+// Delay returns the time to wait before the attempt number n (starting at 1): the initial
+// backoff doubled for each previous attempt, limited to the maximum backoff and randomized
+// with the jitter, so the workers do not retry all at the same time.
+func (p *RetryPolicy) Delay(n int) time.Duration {
+	if p == nil || p.Backoff <= 0 {
+		return 0
+	}
+	delay := p.Backoff
+	for i := 1; i < n && (p.MaxBackoff <= 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 {
+		delay = min(delay, p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return delay
+}
+
+// Reconnects checks if the policy allows reconnecting after a connection error
+func (p *RetryPolicy) Reconnects() bool {
+	return p != nil && p.MaxAttempts > 1
+}
+
+// connect opens the session, making up to MaxAttempts attempts limited by timeout. If retry is
+// true, the session is being reopened after an error and the backoff delay is also applied
+// before the first attempt. It returns the time spent in the successful attempt.
+func (p *RetryPolicy) connect(ctx context.Context, sess *IMSconSess, retry bool, timeout time.Duration) (time.Duration, error) {
+	attempts := 1
+	if p.Reconnects() {
+		attempts = p.MaxAttempts
+	}
+	var err error
+	for n := 1; n <= attempts; n++ {
+		if retry || n > 1 {
+			err = sleep(ctx, p.Delay(n))
+			if err != nil {
+				return 0, err
+			}
+		}
+		start := time.Now()
+		err = sess.ConnectContext(ctx, timeout)
+		if err == nil {
+			return time.Since(start), nil
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if n < attempts {
+			log.Warnf("Connection attempt %d of %d failed: %v", n, attempts, err)
+		}
+	}
+	return 0, err
+}
+
+// sleep waits for a duration, unless the context is cancelled before
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
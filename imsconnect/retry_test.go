@@ -0,0 +1,109 @@
+package imsconnect
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm"
+)
+
+func TestParseRetryRules(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []RetryRule
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "  ", want: nil},
+		{spec: "20", want: []RetryRule{{Retcode: 0x20, AnyReason: true, Retries: 1}}},
+		{spec: "0x0C", want: []RetryRule{{Retcode: 0x0C, AnyReason: true, Retries: 1}}},
+		{spec: "20:3,8/38", want: []RetryRule{
+			{Retcode: 0x20, AnyReason: true, Retries: 3},
+			{Retcode: 0x08, Rsncode: 0x38, Retries: 1},
+		}},
+		{spec: "0x8/0x1A:2, 4", want: []RetryRule{
+			{Retcode: 0x08, Rsncode: 0x1A, Retries: 2},
+			{Retcode: 0x04, AnyReason: true, Retries: 1},
+		}},
+		{spec: "zz", wantErr: true},
+		{spec: "8/zz", wantErr: true},
+		{spec: "8:0", wantErr: true},
+		{spec: "8:x", wantErr: true},
+		{spec: "8,", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRetryRules(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRetryRules(%q) did not fail", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRetryRules(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRetryRules(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyRetries(t *testing.T) {
+	rules, err := ParseRetryRules("20:3,8/38")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &RetryPolicy{Rules: rules}
+
+	tests := []struct {
+		policy *RetryPolicy
+		rsm    *irm.RSM
+		want   int
+	}{
+		{policy, nil, 0},
+		{nil, &irm.RSM{Retcode: 0x20}, 0},
+		{policy, &irm.RSM{Retcode: 0x20, Rsncode: 0x1E}, 3},
+		{policy, &irm.RSM{Retcode: 0x08, Rsncode: 0x38}, 1},
+		{policy, &irm.RSM{Retcode: 0x08, Rsncode: 0x28}, 0},
+		{policy, &irm.RSM{Retcode: 0x0C}, 0},
+	}
+	for _, tt := range tests {
+		got := tt.policy.Retries(tt.rsm)
+		if got != tt.want {
+			t.Errorf("Retries(%+v) = %d, want %d", tt.rsm, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *RetryPolicy
+		n      int
+		want   time.Duration
+	}{
+		{"nil policy", nil, 1, 0},
+		{"no backoff", &RetryPolicy{}, 3, 0},
+		{"first attempt", &RetryPolicy{Backoff: 100 * time.Millisecond}, 1, 100 * time.Millisecond},
+		{"third attempt", &RetryPolicy{Backoff: 100 * time.Millisecond}, 3, 400 * time.Millisecond},
+		{"limited", &RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 250 * time.Millisecond}, 3, 250 * time.Millisecond},
+		{"many attempts", &RetryPolicy{Backoff: time.Second, MaxBackoff: time.Minute}, 1000, time.Minute},
+	}
+	for _, tt := range tests {
+		got := tt.policy.Delay(tt.n)
+		if got != tt.want {
+			t.Errorf("%s: Delay(%d) = %v, want %v", tt.name, tt.n, got, tt.want)
+		}
+	}
+
+	// The jitter keeps the delays within its fraction of them
+	policy := &RetryPolicy{Backoff: 100 * time.Millisecond, Jitter: DEFAULT_JITTER}
+	for range 100 {
+		got := policy.Delay(2)
+		if got < 160*time.Millisecond || got > 240*time.Millisecond {
+			t.Errorf("Delay(2) with jitter = %v, out of range", got)
+		}
+	}
+}
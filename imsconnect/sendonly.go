@@ -0,0 +1,101 @@
+package imsconnect
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm"
+)
+
+// SendMode is the type of the messages sent to IMS. The zero value keeps the message
+// type of the IRM template.
+//
+// The send-only messages start transactions that do not answer the client, like the
+// asynchronous transactions replying to another LTERM or to no one. IMS Connect does not
+// return their output, so the response of a send-only request has no segments. With the
+// ordered delivery option, OTMA queues the send-only messages of a client ID (TPIPE) in
+// the order they are received.
+type SendMode uint8
+
+const (
+	SEND_DEFAULT    SendMode = iota // IRM template value (send-receive for NewIRM)
+	SEND_RECEIVE                    // Send-receive: IMS returns the output of the transaction
+	SEND_ONLY                       // Send-only: nothing is returned
+	SEND_ONLY_ACK                   // Send-only with ACK: IMS Connect answers once OTMA accepts the message
+	SEND_ONLY_ERROR                 // Send-only with error return: IMS Connect only answers if the message is rejected
+)
+
+// Default time to wait for an error after a send-only message with error return
+const DEFAULT_SENDONLY_WAIT = 500 * time.Millisecond
+
+// ParseSendMode converts a message type name (sendrec, sendonly, sendonlya or sendonlye)
+func ParseSendMode(s string) (SendMode, error) {
+	switch strings.ToLower(s) {
+	case "sendrec":
+		return SEND_RECEIVE, nil
+	case "sendonly":
+		return SEND_ONLY, nil
+	case "sendonlya":
+		return SEND_ONLY_ACK, nil
+	case "sendonlye":
+		return SEND_ONLY_ERROR, nil
+	default:
+		return SEND_DEFAULT, fmt.Errorf("invalid message type %s, expected sendrec, sendonly, sendonlya or sendonlye", s)
+	}
+}
+
+func (m SendMode) String() string {
+	switch m {
+	case SEND_RECEIVE:
+		return "sendrec"
+	case SEND_ONLY:
+		return "sendonly"
+	case SEND_ONLY_ACK:
+		return "sendonlya"
+	case SEND_ONLY_ERROR:
+		return "sendonlye"
+	default:
+		return "default"
+	}
+}
+
+// apply sets the message type into an IRM, unless it is the default. The text of
+// the send-only ACKs is not requested, since it is not used.
+func (m SendMode) apply(i *irm.IRM) {
+	user := &i.Irm_user
+	switch m {
+	case SEND_RECEIVE:
+		user.Irm_f4 = irm.IRM_F4_SENDREC
+	case SEND_ONLY:
+		user.Irm_f4 = irm.IRM_F4_SENDONLY
+	case SEND_ONLY_ACK:
+		user.Irm_f4 = irm.IRM_F4_SNDONLYA
+	case SEND_ONLY_ERROR:
+		user.Irm_f4 = irm.IRM_F4_SNDONLYE
+	default:
+		return
+	}
+	user.Irm_f1 &^= irm.IRM_F1_SOARSP
+	if m == SEND_ONLY_ACK {
+		user.Irm_f1 |= irm.IRM_F1_SOARSP
+	}
+}
+
+// applyOrdered sets or clears the ordered delivery flag of the send-only messages
+func applyOrdered(i *irm.IRM, ordered bool) {
+	if ordered {
+		i.Irm_user.Irm_f3 |= irm.IRM_F3_ORDER
+	} else {
+		i.Irm_user.Irm_f3 &^= irm.IRM_F3_ORDER
+	}
+}
+
+// isSendOnly checks if an IRM sends a send-only message
+func isSendOnly(i *irm.IRM) bool {
+	switch i.Irm_user.Irm_f4 {
+	case irm.IRM_F4_SENDONLY, irm.IRM_F4_SNDONLYA, irm.IRM_F4_SNDONLYE:
+		return true
+	}
+	return false
+}
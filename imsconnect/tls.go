@@ -0,0 +1,61 @@
+package imsconnect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLS versions accepted as minimum version
+var TLS_versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig builds the TLS configuration used to connect to an SSL enabled IMS Connect port.
+//
+// caFile is a PEM file with the CA certificates used to verify the IMS Connect certificate. If it
+// is empty, the system certificate pool is used. certFile and keyFile are the PEM files containing
+// the client certificate and key, needed if IMS Connect requires client authentication. serverName
+// overrides the name used to verify the server certificate (the host name is used by default), and
+// minVersion is the minimum TLS version accepted ("1.0", "1.1", "1.2" or "1.3").
+func NewTLSConfig(caFile string, certFile string, keyFile string, serverName string, minVersion string) (*tls.Config, error) {
+	version, ok := TLS_versions[strings.TrimSpace(minVersion)]
+	if !ok {
+		return nil, fmt.Errorf("invalid minimum TLS version: %s", minVersion)
+	}
+
+	config := &tls.Config{
+		MinVersion: version,
+		ServerName: serverName,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in CA file %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both the client certificate and the client key must be specified")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
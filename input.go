@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jguillaumes/ims-injector/imsconnect"
+	"github.com/jguillaumes/ims-injector/internal/assertions"
+	"github.com/jguillaumes/ims-injector/internal/irm_net"
+	"github.com/jguillaumes/ims-injector/internal/templating"
+)
+
+// transactionReader reads the transactions from the input file.
+// Next returns io.EOF when there are no more transactions.
+type transactionReader interface {
+	Next() (irm_net.Transaction, error)
+}
+
+// Tags delimiting a multi-segment message, an expectation block and a conversation
+// in the text input format
+const (
+	MSG_BEGIN    = "<msg>"
+	MSG_END      = "</msg>"
+	EXPECT_BEGIN = "<expect>"
+	EXPECT_END   = "</expect>"
+	CONV_BEGIN   = "<conv>"
+	CONV_END     = "</conv>"
+)
+
+// newTransactionReader creates the reader for an input format (text or jsonl).
+// If separator is not empty, the text lines are split into segments using it.
+func newTransactionReader(format string, r io.Reader, separator string) (transactionReader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	switch strings.ToLower(format) {
+	case FORMAT_TEXT:
+		return &textReader{scanner: scanner, separator: separator}, nil
+	case FORMAT_JSONL:
+		return &jsonlReader{scanner: scanner}, nil
+	default:
+		return nil, fmt.Errorf("unknown input format %s", format)
+	}
+}
+
+// nextLine returns the next line which is not empty nor a comment (starting with an asterisk)
+func nextLine(scanner *bufio.Scanner, line *int) (string, error) {
+	for scanner.Scan() {
+		*line++
+		msg := scanner.Text()
+		if msg == "" || msg[0:1] == "*" {
+			continue // Skip empty lines and comments
+		}
+		return msg, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+// textReader reads one transaction per line. A line can contain several segments
+// split by a separator, and a multi-segment message can also be written as a block
+// with one segment per line, between <msg> and </msg> lines. A transaction can be
+// followed by an expectation block, between <expect> and </expect> lines. The transactions
+// between <conv> and </conv> lines are the steps of a conversation.
+type textReader struct {
+	scanner     *bufio.Scanner
+	line        int
+	separator   string
+	pending     string // Line read after a transaction, looking for its expectation
+	pendingLine int
+}
+
+func (t *textReader) Next() (irm_net.Transaction, error) {
+	msg, err := t.nextLine()
+	if err != nil {
+		return irm_net.Transaction{}, err
+	}
+	switch strings.TrimSpace(msg) {
+	case CONV_BEGIN:
+		return t.conversation()
+	case CONV_END:
+		return irm_net.Transaction{}, fmt.Errorf("line %d: %s without a conversation", t.line, CONV_END)
+	}
+	return t.transaction(msg)
+}
+
+// conversation reads the steps of a conversation, up to the </conv> line
+func (t *textReader) conversation() (irm_net.Transaction, error) {
+	conv := irm_net.Transaction{Line: t.line}
+	for {
+		msg, err := t.nextLine()
+		if err == io.EOF {
+			return conv, fmt.Errorf("line %d: conversation not ended by %s", conv.Line, CONV_END)
+		}
+		if err != nil {
+			return conv, err
+		}
+		switch strings.TrimSpace(msg) {
+		case CONV_END:
+			if len(conv.Steps) == 0 {
+				return conv, fmt.Errorf("line %d: empty conversation", conv.Line)
+			}
+			return conv, nil
+		case CONV_BEGIN:
+			return conv, fmt.Errorf("line %d: conversations can not be nested", t.line)
+		}
+		step, err := t.transaction(msg)
+		if err != nil {
+			return conv, err
+		}
+		step.Conversation = conv.Line
+		step.Step = len(conv.Steps) + 1
+		conv.Steps = append(conv.Steps, step)
+	}
+}
+
+// transaction reads the transaction starting with the line msg, and its expectation
+func (t *textReader) transaction(msg string) (irm_net.Transaction, error) {
+	var tran irm_net.Transaction
+	var err error
+	switch {
+	case strings.TrimSpace(msg) == MSG_BEGIN:
+		tran, err = t.block()
+		if err != nil {
+			return tran, err
+		}
+	case strings.TrimSpace(msg) == EXPECT_BEGIN:
+		return tran, fmt.Errorf("line %d: expectation without a transaction", t.line)
+	case t.separator != "" && strings.Contains(msg, t.separator):
+		segments := strings.Split(msg, t.separator)
+		tran = irm_net.Transaction{Line: t.line, Text: strings.Join(segments, "\n"), Segments: segments}
+	default:
+		tran = irm_net.Transaction{Line: t.line, Text: msg}
+	}
+
+	// Look for an expectation after the transaction
+	msg, err = t.nextLine()
+	if err == io.EOF {
+		return tran, nil
+	}
+	if err != nil {
+		return tran, err
+	}
+	if strings.TrimSpace(msg) != EXPECT_BEGIN {
+		t.pending, t.pendingLine = msg, t.line
+		return tran, nil
+	}
+	tran.Expect, err = t.expectation()
+	if err != nil {
+		return tran, err
+	}
+	tran.Overrides = expectOverrides(tran.Expect, tran.Overrides)
+	return tran, nil
+}
+
+// nextLine returns the line kept by the last transaction, or reads a new one
+func (t *textReader) nextLine() (string, error) {
+	if t.pending != "" {
+		msg := t.pending
+		t.line = t.pendingLine
+		t.pending = ""
+		return msg, nil
+	}
+	return nextLine(t.scanner, &t.line)
+}
+
+// expectation reads the checks of an expectation block, up to the </expect> line.
+// Each line contains a keyword, optionally followed by a blank and its value.
+func (t *textReader) expectation() (*assertions.Expectation, error) {
+	start := t.line
+	expect := &assertions.Expectation{}
+	for {
+		msg, err := nextLine(t.scanner, &t.line)
+		if err == io.EOF {
+			return nil, fmt.Errorf("line %d: expectation block not ended by %s", start, EXPECT_END)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(msg) == EXPECT_END {
+			return expect, nil
+		}
+		keyword, value, _ := strings.Cut(msg, " ")
+		err = expect.Set(keyword, value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", t.line, err)
+		}
+	}
+}
+
+// block reads the segments of a multi-segment message, up to the </msg> line.
+// The lines are taken literally, so they can not be empty.
+func (t *textReader) block() (irm_net.Transaction, error) {
+	tran := irm_net.Transaction{Line: t.line}
+	for t.scanner.Scan() {
+		t.line++
+		segment := t.scanner.Text()
+		if strings.TrimSpace(segment) == MSG_END {
+			if len(tran.Segments) == 0 {
+				return tran, fmt.Errorf("line %d: empty message block", tran.Line)
+			}
+			tran.Text = strings.Join(tran.Segments, "\n")
+			return tran, nil
+		}
+		if segment == "" {
+			return tran, fmt.Errorf("line %d: empty segment in message block", t.line)
+		}
+		tran.Segments = append(tran.Segments, segment)
+	}
+	if err := t.scanner.Err(); err != nil {
+		return tran, err
+	}
+	return tran, fmt.Errorf("line %d: message block not ended by %s", tran.Line, MSG_END)
+}
+
+// jsonTransaction is a transaction in the JSON Lines input format
+type jsonTransaction struct {
+	Text       string      `json:"text"`
+	Segments   []string    `json:"segments"`
+	Lterm      string      `json:"lterm"`
+	User       string      `json:"user"`
+	Password   string      `json:"password"`
+	Group      string      `json:"group"`
+	Datastore  string      `json:"datastore"`
+	Timeout    *int        `json:"timeout"`
+	RequestMod *bool       `json:"request_mod"`
+	CommitMode *int        `json:"commit_mode"`
+	SyncLevel  string      `json:"sync_level"`
+	Nak        string      `json:"nak"`
+	SendMode   string      `json:"send_mode"`
+	Ordered    *bool       `json:"ordered"`
+	Expect     *jsonExpect `json:"expect"`
+
+	Conversation []jsonTransaction `json:"conversation"` // Steps of a conversation, alone in its line
+}
+
+// jsonExpect is the expectation of a transaction in the JSON Lines input format
+type jsonExpect struct {
+	Exact    stringList `json:"exact"`
+	Regex    stringList `json:"regex"`
+	Contains stringList `json:"contains"`
+	Segments int        `json:"segments"`
+	Modname  string     `json:"modname"`
+	NoDFS    bool       `json:"no_dfs"`
+}
+
+// stringList is a list of strings that can also be written as a single string
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*l = []string{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// String and Set make stringList usable as a repeatable flag
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// expectation validates a JSON expectation and builds the Expectation to be checked
+func (r *jsonExpect) expectation() (*assertions.Expectation, error) {
+	expect := &assertions.Expectation{NoDFS: r.NoDFS}
+	set := func(keyword string, values ...string) error {
+		for _, value := range values {
+			err := expect.Set(keyword, value)
+			if err != nil {
+				return fmt.Errorf("invalid expectation: %v", err)
+			}
+		}
+		return nil
+	}
+	err := errors.Join(
+		set(assertions.EXPECT_EXACT, r.Exact...),
+		set(assertions.EXPECT_REGEX, r.Regex...),
+		set(assertions.EXPECT_CONTAINS, r.Contains...),
+	)
+	if err == nil && r.Segments != 0 {
+		err = set(assertions.EXPECT_SEGMENTS, strconv.Itoa(r.Segments))
+	}
+	if err == nil && r.Modname != "" {
+		err = set(assertions.EXPECT_MODNAME, r.Modname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return expect, nil
+}
+
+// expectOverrides requests the MOD name of the response when an expectation checks it,
+// unless the transaction sets request_mod explicitly
+func expectOverrides(expect *assertions.Expectation, overrides *imsconnect.Overrides) *imsconnect.Overrides {
+	if expect.Modname == "" || (overrides != nil && overrides.RequestMod != nil) {
+		return overrides
+	}
+	if overrides == nil {
+		overrides = &imsconnect.Overrides{}
+	}
+	requestMod := true
+	overrides.RequestMod = &requestMod
+	return overrides
+}
+
+// jsonlReader reads one JSON object per line, allowing to override some IRM values
+// for each transaction
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (j *jsonlReader) Next() (irm_net.Transaction, error) {
+	msg, err := nextLine(j.scanner, &j.line)
+	if err != nil {
+		return irm_net.Transaction{}, err
+	}
+
+	var record jsonTransaction
+	decoder := json.NewDecoder(strings.NewReader(msg))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&record)
+	if err != nil {
+		return irm_net.Transaction{}, fmt.Errorf("line %d: invalid JSON transaction: %v", j.line, err)
+	}
+	if record.Conversation != nil {
+		return j.conversation(msg, record.Conversation)
+	}
+	tran, err := record.transaction(j.line)
+	if err != nil {
+		return irm_net.Transaction{}, fmt.Errorf("line %d: %v", j.line, err)
+	}
+	return tran, nil
+}
+
+// conversation validates the steps of a conversation line. The conversation line has
+// no other fields, and the steps are send-receive transactions, not conversations.
+func (j *jsonlReader) conversation(msg string, steps []jsonTransaction) (irm_net.Transaction, error) {
+	conv := irm_net.Transaction{Line: j.line}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(msg), &fields) == nil && len(fields) > 1 {
+		return conv, fmt.Errorf("line %d: a conversation can only contain its steps", j.line)
+	}
+	if len(steps) == 0 {
+		return conv, fmt.Errorf("line %d: empty conversation", j.line)
+	}
+	for n := range steps {
+		step := &steps[n]
+		if step.Conversation != nil {
+			return conv, fmt.Errorf("line %d: step %d: conversations can not be nested", j.line, n+1)
+		}
+		tran, err := step.transaction(j.line)
+		if err != nil {
+			return conv, fmt.Errorf("line %d: step %d: %v", j.line, n+1, err)
+		}
+		if tran.Overrides.SendMode != imsconnect.SEND_DEFAULT && tran.Overrides.SendMode != imsconnect.SEND_RECEIVE {
+			return conv, fmt.Errorf("line %d: step %d: the conversation steps must be send-receive messages", j.line, n+1)
+		}
+		tran.Conversation = j.line
+		tran.Step = n + 1
+		conv.Steps = append(conv.Steps, tran)
+	}
+	return conv, nil
+}
+
+// transaction validates a JSON transaction and builds the Transaction to be sent
+func (r *jsonTransaction) transaction(line int) (irm_net.Transaction, error) {
+	tran := irm_net.Transaction{Line: line}
+	switch {
+	case r.Text != "" && len(r.Segments) > 0:
+		return tran, fmt.Errorf("text and segments can not be specified at the same time")
+	case r.Text != "":
+		tran.Segments = []string{r.Text}
+	case len(r.Segments) > 0:
+		tran.Segments = r.Segments
+	default:
+		return tran, fmt.Errorf("the transaction has no text nor segments")
+	}
+	tran.Text = strings.Join(tran.Segments, "\n")
+
+	for name, value := range map[string]string{"lterm": r.Lterm, "user": r.User, "password": r.Password, "group": r.Group, "datastore": r.Datastore} {
+		if len(value) > 8 {
+			return tran, fmt.Errorf("%s %s is longer than 8 characters", name, value)
+		}
+	}
+	overrides := &imsconnect.Overrides{
+		Lterm:      r.Lterm,
+		User:       r.User,
+		Password:   r.Password,
+		Group:      r.Group,
+		Datastore:  r.Datastore,
+		RequestMod: r.RequestMod,
+	}
+	if r.Timeout != nil {
+		if *r.Timeout < 0 || *r.Timeout > 60 {
+			return tran, fmt.Errorf("timeout must be between 0 and 60 seconds")
+		}
+		timeout := convert_timeout(*r.Timeout)
+		overrides.Timeout = &timeout
+	}
+	if r.CommitMode != nil {
+		switch *r.CommitMode {
+		case 0:
+			overrides.CommitMode = imsconnect.CM0
+		case 1:
+			overrides.CommitMode = imsconnect.CM1
+		default:
+			return tran, fmt.Errorf("commit mode must be 0 or 1")
+		}
+	}
+	if r.SyncLevel != "" {
+		sync, err := imsconnect.ParseSyncLevel(r.SyncLevel)
+		if err != nil {
+			return tran, err
+		}
+		overrides.SyncLevel = sync
+	}
+	if r.SendMode != "" {
+		mode, err := imsconnect.ParseSendMode(r.SendMode)
+		if err != nil {
+			return tran, err
+		}
+		if mode != imsconnect.SEND_RECEIVE && r.Expect != nil {
+			return tran, fmt.Errorf("the send-only messages have no response to check")
+		}
+		overrides.SendMode = mode
+	}
+	overrides.Ordered = r.Ordered
+	if r.Nak != "" {
+		if !irm_net.ValidNakMode(r.Nak) {
+			return tran, fmt.Errorf("invalid nak mode %s, expected none, all or failed", r.Nak)
+		}
+		tran.Nak = strings.ToLower(r.Nak)
+	}
+	tran.Overrides = overrides
+	if r.Expect != nil {
+		expect, err := r.Expect.expectation()
+		if err != nil {
+			return tran, err
+		}
+		tran.Expect = expect
+		tran.Overrides = expectOverrides(expect, tran.Overrides)
+	}
+	return tran, nil
+}
+
+// templateReader expands the placeholders of the transactions read by another reader
+type templateReader struct {
+	reader   transactionReader
+	expander *templating.Expander
+}
+
+func (t *templateReader) Next() (irm_net.Transaction, error) {
+	tran, err := t.reader.Next()
+	if err != nil {
+		return tran, err
+	}
+	if !tran.IsConversation() {
+		return t.expand(tran)
+	}
+	for i := range tran.Steps {
+		tran.Steps[i], err = t.expand(tran.Steps[i])
+		if err != nil {
+			return tran, err
+		}
+	}
+	return tran, nil
+}
+
+// expand expands the placeholders of the segments of a transaction
+func (t *templateReader) expand(tran irm_net.Transaction) (irm_net.Transaction, error) {
+	segments := tran.Segments
+	if len(segments) == 0 {
+		segments = []string{tran.Text}
+	}
+	segments, err := t.expander.Expand(segments)
+	if err != nil {
+		return tran, fmt.Errorf("line %d: %v", tran.Line, err)
+	}
+	tran.Segments = segments
+	tran.Text = strings.Join(segments, "\n")
+	return tran, nil
+}
+
+// variables collects the NAME=value definitions of the repeatable -D flag
+type variables map[string]string
+
+func (v variables) String() string {
+	return fmt.Sprintf("%d variables", len(v))
+}
+
+func (v variables) Set(def string) error {
+	name, value, err := templating.ParseVariable(def)
+	if err != nil {
+		return err
+	}
+	v[name] = value
+	return nil
+}
@@ -0,0 +1,171 @@
+// Package assertions checks the responses of the transactions against the expected values
+// attached to them in the input file.
+//
+// The response text used by the regex and contains checks is made of the response segments
+// joined by newlines. The trailing blanks of the segments are ignored by the exact check,
+// since IMS usually pads the output segments.
+package assertions
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// IMS error and information messages, like DFS2082 or DFS065I
+var dfs_regex = regexp.MustCompile(`\bDFS\d{3,4}[A-Z]?\b`)
+
+// Keywords of the expectations, in the text and JSON input formats
+const (
+	EXPECT_EXACT    = "exact"
+	EXPECT_REGEX    = "regex"
+	EXPECT_CONTAINS = "contains"
+	EXPECT_SEGMENTS = "segments"
+	EXPECT_MODNAME  = "modname"
+	EXPECT_NODFS    = "no_dfs"
+)
+
+// Expectation contains the checks to be done on the response of a transaction.
+// The zero values disable the corresponding checks.
+type Expectation struct {
+	Exact    []string         // Expected response segments
+	Regex    []*regexp.Regexp // Patterns the response text must match
+	Contains []string         // Strings the response text must contain
+	Segments int              // Expected number of segments
+	Modname  string           // Expected MFS MOD name (requires the MOD name to be requested)
+	NoDFS    bool             // The response must not contain DFS messages
+}
+
+// Set adds a check to the expectation, given its keyword and value. The exact, regex and
+// contains keywords can be repeated: each exact value is an expected segment.
+func (e *Expectation) Set(keyword, value string) error {
+	switch strings.ToLower(keyword) {
+	case EXPECT_EXACT:
+		e.Exact = append(e.Exact, value)
+	case EXPECT_REGEX:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("invalid regex %s: %v", value, err)
+		}
+		e.Regex = append(e.Regex, re)
+	case EXPECT_CONTAINS:
+		if value == "" {
+			return fmt.Errorf("empty contains value")
+		}
+		e.Contains = append(e.Contains, value)
+	case EXPECT_SEGMENTS:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid number of segments %s", value)
+		}
+		e.Segments = n
+	case EXPECT_MODNAME:
+		if value == "" || len(value) > 8 {
+			return fmt.Errorf("invalid MOD name %s", value)
+		}
+		e.Modname = value
+	case EXPECT_NODFS, "nodfs":
+		if value != "" {
+			return fmt.Errorf("%s does not take a value", keyword)
+		}
+		e.NoDFS = true
+	default:
+		return fmt.Errorf("unknown expectation %s", keyword)
+	}
+	return nil
+}
+
+// Check checks a response and returns the description of each failed check, or nil
+// if the response meets the expectation. A failed exact check includes a diff of the
+// expected and the received segments.
+func (e *Expectation) Check(segments []string, modname string) []string {
+	var failures []string
+	text := strings.Join(segments, "\n")
+
+	if e.Exact != nil && !EqualSegments(e.Exact, segments) {
+		failures = append(failures, "response differs from the expected one:\n"+Diff(e.Exact, segments))
+	}
+	for _, re := range e.Regex {
+		if !re.MatchString(text) {
+			failures = append(failures, fmt.Sprintf("response does not match %s", re))
+		}
+	}
+	for _, s := range e.Contains {
+		if !strings.Contains(text, s) {
+			failures = append(failures, fmt.Sprintf("response does not contain %q", s))
+		}
+	}
+	if e.Segments > 0 && len(segments) != e.Segments {
+		failures = append(failures, fmt.Sprintf("expected %d segments, received %d", e.Segments, len(segments)))
+	}
+	if e.Modname != "" && strings.TrimSpace(modname) != strings.TrimSpace(e.Modname) {
+		failures = append(failures, fmt.Sprintf("expected MOD name %s, received %q", e.Modname, strings.TrimSpace(modname)))
+	}
+	if e.NoDFS {
+		if msg := dfs_regex.FindString(text); msg != "" {
+			failures = append(failures, fmt.Sprintf("response contains the IMS message %s", msg))
+		}
+	}
+	return failures
+}
+
+// EqualSegments compares two lists of segments, ignoring their trailing blanks
+func EqualSegments(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.TrimRight(a[i], " ") != strings.TrimRight(b[i], " ") {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff returns a line diff of two lists of segments, ignoring their trailing blanks.
+// The segments only in expected are prefixed with "- ", the segments only in actual with "+ "
+// and the common segments with two blanks.
+func Diff(expected, actual []string) string {
+	a := make([]string, len(expected))
+	for i, s := range expected {
+		a[i] = strings.TrimRight(s, " ")
+	}
+	b := make([]string, len(actual))
+	for i, s := range actual {
+		b[i] = strings.TrimRight(s, " ")
+	}
+
+	// Longest common subsequence of the suffixes
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(&sb, "  %s\n", a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&sb, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&sb, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
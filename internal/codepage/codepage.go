@@ -0,0 +1,176 @@
+// Package codepage converts messages between golang strings and the single byte
+// codepages (EBCDIC CCSIDs) used by IMS.
+//
+// The translation tables are taken from [github.com/jguillaumes/go-encoding/encodings]
+// when available there. Additional tables, in the same CodecMapper format, are
+// embedded from the tables subdirectory.
+package codepage
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	e "github.com/jguillaumes/go-encoding/encodings"
+)
+
+// Additional tables not provided by go-encoding
+//
+//go:embed tables
+var extra_tables embed.FS
+
+// Same format used by go-encoding (CodecMapper output)
+var table_regex = regexp.MustCompile("^0x([0-9a-f]{2})\\s+0x([0-9a-f]{4})\\s+.*")
+
+// A Codepage contains the tables to encode and decode a single byte codepage.
+// A Codepage is read-only once built, so it can be shared between goroutines.
+// A nil *Codepage means no conversion at all: strings are sent and received as they are.
+type Codepage struct {
+	Name     string // Table name (IBM-037, IBM-1140...)
+	DumpName string // Codepage name to be used with go-hexdump
+	encMap   map[rune]byte
+	decTable []rune
+}
+
+var (
+	cacheLock sync.Mutex
+	cache     = make(map[string]*Codepage)
+)
+
+// Lookup returns the Codepage for a CCSID. The CCSID can be specified as a number
+// (37, 037, 1140...) or as a table name (IBM-037, IBM-1140...).
+func Lookup(ccsid string) (*Codepage, error) {
+	name := normalizeName(ccsid)
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	cp, ok := cache[name]
+	if ok {
+		return cp, nil
+	}
+	cp, err := build(name)
+	if err != nil {
+		return nil, err
+	}
+	cache[name] = cp
+	return cp, nil
+}
+
+// List returns the names of all the available codepages
+func List() []string {
+	list := e.NewEncoding().ListEncodings()
+	files, _ := extra_tables.ReadDir("tables")
+	for _, f := range files {
+		list = append(list, strings.TrimSuffix(f.Name(), ".txt"))
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Encode converts a string into the codepage bytes. It fails if some character
+// can not be represented in the codepage.
+func (cp *Codepage) Encode(s string) ([]byte, error) {
+	if cp == nil {
+		return []byte(s), nil
+	}
+	buf := make([]byte, 0, len(s))
+	for _, r := range s {
+		b, ok := cp.encMap[r]
+		if !ok {
+			return nil, fmt.Errorf("character %q can not be represented in %s", r, cp.Name)
+		}
+		buf = append(buf, b)
+	}
+	return buf, nil
+}
+
+// Decode converts a byte slice in the codepage into a string
+func (cp *Codepage) Decode(b []byte) string {
+	if cp == nil {
+		return string(b)
+	}
+	var builder strings.Builder
+	for _, c := range b {
+		builder.WriteRune(cp.decTable[c])
+	}
+	return builder.String()
+}
+
+// DumpCodepage returns the codepage name to be used in hexadecimal dumps
+func (cp *Codepage) DumpCodepage() string {
+	if cp == nil {
+		return "ISO8859-1"
+	}
+	return cp.DumpName
+}
+
+// normalizeName converts a CCSID specification into a table name
+func normalizeName(ccsid string) string {
+	name := strings.ToUpper(strings.TrimSpace(ccsid))
+	name = strings.TrimPrefix(name, "IBM-")
+	name = strings.TrimPrefix(name, "IBM")
+	name = strings.TrimPrefix(name, "CP")
+	n, err := strconv.Atoi(name)
+	if err != nil {
+		return strings.ToUpper(strings.TrimSpace(ccsid))
+	}
+	return fmt.Sprintf("IBM-%03d", n)
+}
+
+// build creates a Codepage, taking the tables from go-encoding or from the embedded ones
+func build(name string) (*Codepage, error) {
+	enc := e.NewEncoding()
+	for _, known := range enc.ListEncodings() {
+		if known != name {
+			continue
+		}
+		encMap, err := enc.GetEncodingMapFor(name)
+		if err != nil {
+			return nil, err
+		}
+		decTable, err := enc.GetDecodingTableFor(name)
+		if err != nil {
+			return nil, err
+		}
+		return &Codepage{
+			Name:     name,
+			DumpName: name,
+			encMap:   *encMap,
+			decTable: *decTable,
+		}, nil
+	}
+
+	data, err := extra_tables.ReadFile(path.Join("tables", name+".txt"))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported codepage %s. Available codepages: %s", name, strings.Join(List(), ", "))
+	}
+	cp := &Codepage{
+		Name:     name,
+		DumpName: "IBM-037", // Close enough to show the text in a dump
+		encMap:   make(map[rune]byte),
+		decTable: make([]rune, 256),
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := table_regex.FindStringSubmatch(scanner.Text())
+		if len(parts) != 3 {
+			continue // Comments
+		}
+		b, _ := strconv.ParseUint(parts[1], 16, 8)
+		r, _ := strconv.ParseUint(parts[2], 16, 16)
+		cp.decTable[b] = rune(r)
+		cp.encMap[rune(r)] = byte(b)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
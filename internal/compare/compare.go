@@ -0,0 +1,323 @@
+// Package compare aligns the results of two injector runs and reports the responses
+// added, removed or changed between them.
+//
+// The result files can be in the text format (<resp>...</resp>) or in the jsonl format,
+// and the format of each file is detected from its contents. The results are aligned by
+// a key: the input line and iteration (jsonl files only), the input text, a correlation id
+// extracted from the input text by a regular expression, or the order of the results.
+// The responses are compared after applying the ignore rules, and ignoring the trailing
+// blanks of the segments. The failures are compared by their RSM codes or error class.
+package compare
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jguillaumes/ims-injector/internal/assertions"
+)
+
+// Keys used to align the results
+const (
+	KEY_LINE  = "line"  // Input line, conversation step and iteration
+	KEY_INPUT = "input" // Input text
+	KEY_ORDER = "order" // Position of the result in the file
+)
+
+// Status of a compared result
+const (
+	STATUS_IDENTICAL = "identical"
+	STATUS_CHANGED   = "changed"
+	STATUS_REMOVED   = "removed" // Only in the old file
+	STATUS_ADDED     = "added"   // Only in the new file
+)
+
+// Tags of a response and of a conversation in the text result format
+const (
+	RESP_BEGIN = "<resp>"
+	RESP_END   = "</resp>"
+	CONV_BEGIN = "<conv>"
+	CONV_END   = "</conv>"
+)
+
+// Record is a transaction result read from a result file
+type Record struct {
+	Position  int      // Position in the file, starting at 1
+	Line      int      // Input line (0 if unknown)
+	Iteration int      // Iteration over the input file (0 if unknown)
+	Step      int      // Position in its conversation (0 if unknown or not a conversation step)
+	Trancode  string   // Transaction code (empty if unknown)
+	Input     string   // Input text (empty if unknown)
+	OK        bool     // The transaction got a response
+	Segments  []string // Response segments
+	RSM       *RSM     // RSM of the failed transactions (nil if none)
+	Error     string   // Error of the failed transactions
+}
+
+// jsonRecord contains the fields of a jsonl result used in the comparison
+type jsonRecord struct {
+	Line      int      `json:"line,omitempty"`
+	Iteration int      `json:"iteration,omitempty"`
+	Step      int      `json:"step,omitempty"`
+	Trancode  string   `json:"trancode,omitempty"`
+	Input     string   `json:"input,omitempty"`
+	OK        bool     `json:"ok"`
+	Segments  []string `json:"segments"`
+	RSM       *RSM     `json:"rsm,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// RSM contains the return and reason codes of the request status message of a result
+type RSM struct {
+	Retcode uint32 `json:"retcode"`
+	Rsncode uint32 `json:"rsncode"`
+}
+
+// ReadResults reads a result file, in the text or in the jsonl format. It returns true
+// if the file is in the jsonl format.
+func ReadResults(r io.Reader) ([]Record, bool, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		records, err := readJSONL(data)
+		return records, true, err
+	}
+	records, err := readText(data)
+	return records, false, err
+}
+
+// readJSONL reads the results of a jsonl file
+func readJSONL(data []byte) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var record jsonRecord
+		err := json.Unmarshal([]byte(text), &record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid JSON result: %v", line, err)
+		}
+		records = append(records, Record{
+			Position:  len(records) + 1,
+			Line:      record.Line,
+			Iteration: record.Iteration,
+			Step:      record.Step,
+			Trancode:  record.Trancode,
+			Input:     record.Input,
+			OK:        record.OK,
+			Segments:  record.Segments,
+			RSM:       record.RSM,
+			Error:     record.Error,
+		})
+	}
+	return records, scanner.Err()
+}
+
+// readText reads the responses of a text file. The failed transactions are not written
+// in this format, so all the responses read are OK. The conversation tags are skipped.
+func readText(data []byte) ([]Record, error) {
+	var records []Record
+	var current *Record
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		switch {
+		case current == nil && strings.TrimSpace(text) == "":
+			continue
+		case current == nil && (strings.TrimSpace(text) == CONV_BEGIN || strings.TrimSpace(text) == CONV_END):
+			continue
+		case current == nil && strings.TrimSpace(text) == RESP_BEGIN:
+			current = &Record{Position: len(records) + 1, OK: true}
+		case current == nil:
+			return nil, fmt.Errorf("line %d: %s expected", line, RESP_BEGIN)
+		case text == RESP_END:
+			if len(current.Segments) > 0 {
+				current.Trancode = strings.SplitN(current.Segments[0], " ", 2)[0]
+			}
+			records = append(records, *current)
+			current = nil
+		default:
+			current.Segments = append(current.Segments, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		return nil, fmt.Errorf("response not ended by %s", RESP_END)
+	}
+	return records, nil
+}
+
+// KeyFunc returns the key used to align a result
+type KeyFunc func(r *Record) string
+
+// NewKeyFunc returns the function for a key type (line, input or order). If pattern is not
+// empty, the key is the correlation id matched by the pattern in the input text: its first
+// group, or the whole match if it has no groups.
+func NewKeyFunc(key string, pattern string) (KeyFunc, error) {
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key pattern %s: %v", pattern, err)
+		}
+		return func(r *Record) string {
+			match := re.FindStringSubmatch(r.Input)
+			switch {
+			case match == nil:
+				return "" // Aligned by order with the other results without correlation id
+			case len(match) > 1:
+				return match[1]
+			default:
+				return match[0]
+			}
+		}, nil
+	}
+	switch strings.ToLower(key) {
+	case KEY_LINE:
+		return func(r *Record) string {
+			key := fmt.Sprint(r.Line)
+			if r.Step > 0 {
+				key = fmt.Sprintf("%d.%d", r.Line, r.Step)
+			}
+			if r.Iteration > 1 {
+				return fmt.Sprintf("%s/%d", key, r.Iteration)
+			}
+			return key
+		}, nil
+	case KEY_INPUT:
+		return func(r *Record) string { return r.Input }, nil
+	case KEY_ORDER:
+		return func(r *Record) string { return fmt.Sprint(r.Position) }, nil
+	default:
+		return nil, fmt.Errorf("unknown key %s", key)
+	}
+}
+
+// Difference is the outcome of the comparison of the results with the same key
+type Difference struct {
+	Status string  // identical, changed, removed or added
+	Key    string  // Alignment key
+	Old    *Record // Result in the old file (nil if added)
+	New    *Record // Result in the new file (nil if removed)
+	Diff   string  // Diff of the masked segments (changed results only)
+}
+
+// Report contains the outcome of the comparison of two result files
+type Report struct {
+	Differences []Difference // Results not identical, in the order of the old results followed by the added ones
+	Compared    int          // Results found in both files
+	Identical   int
+	Changed     int
+	Removed     int
+	Added       int
+}
+
+// Compare aligns the results of two files by key and compares them, applying the ignore rules.
+// The results are taken in the order of their input lines and iterations, or in the order they
+// appear if the lines are unknown, since the responses of concurrent runs are written in any
+// order. When several results have the same key, they are aligned in that order.
+func Compare(old, new []Record, key KeyFunc, rules *Rules) *Report {
+	report := &Report{}
+	old = sortRecords(old)
+	new = sortRecords(new)
+
+	newByKey := make(map[string][]*Record)
+	for i := range new {
+		k := key(&new[i])
+		newByKey[k] = append(newByKey[k], &new[i])
+	}
+	matched := make(map[*Record]bool)
+
+	for i := range old {
+		o := &old[i]
+		k := key(o)
+		candidates := newByKey[k]
+		if len(candidates) == 0 {
+			report.Removed++
+			report.Differences = append(report.Differences, Difference{Status: STATUS_REMOVED, Key: k, Old: o})
+			continue
+		}
+		n := candidates[0]
+		newByKey[k] = candidates[1:]
+		matched[n] = true
+		report.Compared++
+
+		oldSegments := rules.Apply(o.Segments)
+		newSegments := rules.Apply(n.Segments)
+		if sameOutcome(o, n) && assertions.EqualSegments(oldSegments, newSegments) {
+			report.Identical++
+			continue
+		}
+		report.Changed++
+		report.Differences = append(report.Differences, Difference{
+			Status: STATUS_CHANGED,
+			Key:    k,
+			Old:    o,
+			New:    n,
+			Diff:   assertions.Diff(oldSegments, newSegments),
+		})
+	}
+
+	for i := range new {
+		n := &new[i]
+		if !matched[n] {
+			report.Added++
+			report.Differences = append(report.Differences, Difference{Status: STATUS_ADDED, Key: key(n), New: n})
+		}
+	}
+	return report
+}
+
+// sameOutcome checks if two results succeeded or failed in the same way. The failures are
+// compared by their RSM codes or, without an RSM, by the class of their error (its text up
+// to the first colon), since the error details contain addresses, ports and durations that
+// change from run to run.
+func sameOutcome(a, b *Record) bool {
+	if a.OK != b.OK {
+		return false
+	}
+	if a.RSM != nil || b.RSM != nil {
+		return a.RSM != nil && b.RSM != nil && *a.RSM == *b.RSM
+	}
+	return errorClass(a.Error) == errorClass(b.Error)
+}
+
+// errorClass returns the class of an error message: the operation that failed, like
+// "failed to read response from IMS", without the details
+func errorClass(message string) string {
+	class, _, _ := strings.Cut(message, ": ")
+	return class
+}
+
+// sortRecords returns a copy of the records sorted by input line, iteration and step
+func sortRecords(records []Record) []Record {
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Line != sorted[j].Line {
+			return sorted[i].Line < sorted[j].Line
+		}
+		if sorted[i].Iteration != sorted[j].Iteration {
+			return sorted[i].Iteration < sorted[j].Iteration
+		}
+		return sorted[i].Step < sorted[j].Step
+	})
+	return sorted
+}
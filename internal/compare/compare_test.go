@@ -0,0 +1,156 @@
+package compare
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRulesApply(t *testing.T) {
+	segments := []string{"ACCOUNT 1001 AT 10:15:42", "BALANCE 250.00"}
+	tests := []struct {
+		name    string
+		masks   []string
+		columns []string
+		want    []string
+	}{
+		{
+			name: "no rules",
+			want: segments,
+		},
+		{
+			name:  "mask",
+			masks: []string{`\d\d:\d\d:\d\d`},
+			want:  []string{"ACCOUNT 1001 AT ********", "BALANCE 250.00"},
+		},
+		{
+			name:    "columns of all the segments",
+			columns: []string{"9-12"},
+			want:    []string{"ACCOUNT **** AT 10:15:42", "BALANCE ****00"},
+		},
+		{
+			name:    "single column of a segment",
+			columns: []string{"2:1"},
+			want:    []string{"ACCOUNT 1001 AT 10:15:42", "*ALANCE 250.00"},
+		},
+		{
+			name:    "columns up to the end",
+			columns: []string{"1:14-"},
+			want:    []string{"ACCOUNT 1001 ***********", "BALANCE 250.00"},
+		},
+		{
+			name:    "range beyond the end",
+			columns: []string{"12-40"},
+			want:    []string{"ACCOUNT 100*************", "BALANCE 250***"},
+		},
+		{
+			name:    "columns and mask",
+			masks:   []string{`\d+\.\d+`},
+			columns: []string{"1:9-12"},
+			want:    []string{"ACCOUNT **** AT 10:15:42", "BALANCE ******"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := &Rules{}
+			for _, mask := range tt.masks {
+				if err := rules.AddMask(mask); err != nil {
+					t.Fatalf("AddMask(%q): %v", mask, err)
+				}
+			}
+			for _, spec := range tt.columns {
+				if err := rules.AddColumns(spec); err != nil {
+					t.Fatalf("AddColumns(%q): %v", spec, err)
+				}
+			}
+			got := rules.Apply(segments)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRulesErrors(t *testing.T) {
+	var rules Rules
+	if err := rules.AddMask("("); err == nil {
+		t.Error("AddMask accepted an invalid regular expression")
+	}
+	for _, spec := range []string{"", "0", "x-3", "5-3", "0:1-3", "a:1-3", "1:"} {
+		if err := rules.AddColumns(spec); err == nil {
+			t.Errorf("AddColumns(%q) did not fail", spec)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	old := []Record{
+		{Position: 1, Line: 1, OK: true, Input: "IVTNO DISPLAY LAST1", Segments: []string{"LAST1 TIME 10:15:42"}},
+		{Position: 2, Line: 2, OK: true, Input: "IVTNO DISPLAY LAST2", Segments: []string{"LAST2 ADDRESS OLD"}},
+		{Position: 3, Line: 3, RSM: &RSM{Retcode: 0x0C, Rsncode: 0x08}, Error: "IMS Connect RSM: RC=0C RSN=08"},
+		{Position: 4, Line: 4, Error: "failed to read response from IMS: read tcp 127.0.0.1:50000: i/o timeout"},
+		{Position: 5, Line: 5, OK: true, Input: "IVTNO DISPLAY LAST5", Segments: []string{"LAST5"}},
+	}
+	// The results of a concurrent run, in any order
+	new := []Record{
+		{Position: 1, Line: 4, Error: "failed to read response from IMS: read tcp 127.0.0.1:50123: i/o timeout"},
+		{Position: 2, Line: 2, OK: true, Input: "IVTNO DISPLAY LAST2", Segments: []string{"LAST2 ADDRESS NEW"}},
+		{Position: 3, Line: 1, OK: true, Input: "IVTNO DISPLAY LAST1", Segments: []string{"LAST1 TIME 11:00:03  "}},
+		{Position: 4, Line: 3, RSM: &RSM{Retcode: 0x0C, Rsncode: 0x10}, Error: "IMS Connect RSM: RC=0C RSN=10"},
+		{Position: 5, Line: 6, OK: true, Input: "IVTNO DISPLAY LAST6", Segments: []string{"LAST6"}},
+	}
+	rules := &Rules{}
+	if err := rules.AddMask(`\d\d:\d\d:\d\d`); err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewKeyFunc(KEY_LINE, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := Compare(old, new, key, rules)
+	if report.Compared != 4 || report.Identical != 2 || report.Changed != 2 || report.Removed != 1 || report.Added != 1 {
+		t.Errorf("Compare = %d compared, %d identical, %d changed, %d removed, %d added, want 4, 2, 2, 1, 1",
+			report.Compared, report.Identical, report.Changed, report.Removed, report.Added)
+	}
+	if report.Same() {
+		t.Error("Same() = true for different results")
+	}
+	var got []string
+	for _, d := range report.Differences {
+		got = append(got, d.Status+" "+d.Key)
+	}
+	want := []string{"changed 2", "changed 3", "removed 5", "added 6"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Differences = %q, want %q", got, want)
+	}
+	if diff := report.Differences[0].Diff; !strings.Contains(diff, "- LAST2 ADDRESS OLD") || !strings.Contains(diff, "+ LAST2 ADDRESS NEW") {
+		t.Errorf("Diff = %q, want the old and new segments", diff)
+	}
+
+	if !Compare(old, old, key, nil).Same() {
+		t.Error("Same() = false for the same results")
+	}
+}
+
+func TestSameOutcome(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Record
+		want bool
+	}{
+		{"both OK", Record{OK: true}, Record{OK: true}, true},
+		{"OK and failed", Record{OK: true}, Record{Error: "failed"}, false},
+		{"same RSM", Record{RSM: &RSM{Retcode: 8, Rsncode: 0x38}, Error: "a"}, Record{RSM: &RSM{Retcode: 8, Rsncode: 0x38}, Error: "b"}, true},
+		{"different reason", Record{RSM: &RSM{Retcode: 8, Rsncode: 0x38}}, Record{RSM: &RSM{Retcode: 8, Rsncode: 0x28}}, false},
+		{"RSM and error", Record{RSM: &RSM{Retcode: 8}}, Record{Error: "failed"}, false},
+		{"same error class", Record{Error: "failed to connect: port 1"}, Record{Error: "failed to connect: port 2"}, true},
+		{"different error class", Record{Error: "failed to connect: x"}, Record{Error: "failed to send: x"}, false},
+	}
+	for _, tt := range tests {
+		got := sameOutcome(&tt.a, &tt.b)
+		if got != tt.want {
+			t.Errorf("%s: sameOutcome = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
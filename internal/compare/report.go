@@ -0,0 +1,148 @@
+package compare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Report formats
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+// Same returns true if the files have the same results
+func (r *Report) Same() bool {
+	return r.Changed+r.Removed+r.Added == 0
+}
+
+// Write writes the report in a format (text or json)
+func (r *Report) Write(w io.Writer, format string) error {
+	switch strings.ToLower(format) {
+	case FORMAT_TEXT:
+		return r.writeText(w)
+	case FORMAT_JSON:
+		return r.writeJSON(w)
+	default:
+		return fmt.Errorf("unknown report format %s", format)
+	}
+}
+
+// writeText writes each difference followed by a summary. The changed responses are shown
+// as a diff of the masked segments: "- " for the old ones and "+ " for the new ones.
+func (r *Report) writeText(w io.Writer) error {
+	for _, d := range r.Differences {
+		rec := d.Old
+		if rec == nil {
+			rec = d.New
+		}
+		fmt.Fprintf(w, "%s %s", strings.ToUpper(d.Status), d.describe(rec))
+		switch d.Status {
+		case STATUS_CHANGED:
+			fmt.Fprintln(w)
+			if !sameOutcome(d.Old, d.New) {
+				fmt.Fprintf(w, "- %s\n+ %s\n", outcome(d.Old), outcome(d.New))
+			}
+			if d.Diff != "" {
+				fmt.Fprintln(w, d.Diff)
+			}
+		default:
+			fmt.Fprintf(w, ": %s\n", outcome(rec))
+		}
+	}
+	_, err := fmt.Fprintf(w, "Results: %d compared, %d identical, %d changed, %d removed, %d added\n",
+		r.Compared, r.Identical, r.Changed, r.Removed, r.Added)
+	return err
+}
+
+// describe returns the key, the input line and the transaction code of a result
+func (d *Difference) describe(rec *Record) string {
+	s := fmt.Sprintf("[%s]", d.Key)
+	if rec.Line > 0 {
+		s += fmt.Sprintf(" line %d", rec.Line)
+	}
+	if rec.Trancode != "" {
+		s += " " + rec.Trancode
+	}
+	return s
+}
+
+// outcome summarizes the result of a transaction
+func outcome(rec *Record) string {
+	switch {
+	case !rec.OK && rec.Error != "":
+		return "FAILED: " + rec.Error
+	case !rec.OK:
+		return "FAILED"
+	default:
+		return fmt.Sprintf("OK, %d segments", len(rec.Segments))
+	}
+}
+
+// jsonReport is the JSON representation of a Report
+type jsonReport struct {
+	Summary struct {
+		Compared  int  `json:"compared"`
+		Identical int  `json:"identical"`
+		Changed   int  `json:"changed"`
+		Removed   int  `json:"removed"`
+		Added     int  `json:"added"`
+		Same      bool `json:"same"`
+	} `json:"summary"`
+	Differences []jsonDifference `json:"differences"`
+}
+
+// jsonDifference is the JSON representation of a Difference
+type jsonDifference struct {
+	Status string      `json:"status"`
+	Key    string      `json:"key"`
+	Old    *jsonRecord `json:"old,omitempty"`
+	New    *jsonRecord `json:"new,omitempty"`
+	Diff   []string    `json:"diff,omitempty"`
+}
+
+// writeJSON writes the report as a JSON document
+func (r *Report) writeJSON(w io.Writer) error {
+	var report jsonReport
+	report.Summary.Compared = r.Compared
+	report.Summary.Identical = r.Identical
+	report.Summary.Changed = r.Changed
+	report.Summary.Removed = r.Removed
+	report.Summary.Added = r.Added
+	report.Summary.Same = r.Same()
+	report.Differences = []jsonDifference{}
+	for _, d := range r.Differences {
+		jd := jsonDifference{Status: d.Status, Key: d.Key, Old: toJSON(d.Old), New: toJSON(d.New)}
+		if d.Diff != "" {
+			jd.Diff = strings.Split(d.Diff, "\n")
+		}
+		report.Differences = append(report.Differences, jd)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// toJSON converts a Record to the JSON result representation
+func toJSON(rec *Record) *jsonRecord {
+	if rec == nil {
+		return nil
+	}
+	segments := rec.Segments
+	if segments == nil {
+		segments = []string{}
+	}
+	return &jsonRecord{
+		Line:      rec.Line,
+		Iteration: rec.Iteration,
+		Step:      rec.Step,
+		Trancode:  rec.Trancode,
+		Input:     rec.Input,
+		OK:        rec.OK,
+		Segments:  segments,
+		RSM:       rec.RSM,
+		Error:     rec.Error,
+	}
+}
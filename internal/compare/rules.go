@@ -0,0 +1,146 @@
+package compare
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Character replacing the ignored parts of the responses
+const MASK_CHAR = '*'
+
+// Kinds of ignore rules, in the rules files
+const (
+	RULE_MASK    = "mask"    // Regular expression matching the text to ignore
+	RULE_COLUMNS = "columns" // Range of columns to ignore
+)
+
+// ColumnRange is a range of columns ignored in the response segments. The columns
+// start at 1 and both ends are included.
+type ColumnRange struct {
+	Segment int // Segment the range applies to, starting at 1 (0: all the segments)
+	From    int
+	To      int
+}
+
+// Rules are the parts of the responses ignored in the comparison. The ignored text is
+// replaced by asterisks, so the diffs keep the columns of the responses.
+type Rules struct {
+	Masks   []*regexp.Regexp // The text matched is ignored
+	Columns []ColumnRange
+}
+
+// AddMask adds a regular expression matching text to ignore, like timestamps or counters
+func (r *Rules) AddMask(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid mask %s: %v", pattern, err)
+	}
+	r.Masks = append(r.Masks, re)
+	return nil
+}
+
+// AddColumns adds a range of columns to ignore, specified as from-to or segment:from-to.
+// The end of the range can be omitted to ignore up to the end of the segments.
+func (r *Rules) AddColumns(spec string) error {
+	var cr ColumnRange
+	var err error
+	invalid := fmt.Errorf("invalid column range %s, expected [segment:]from-to", spec)
+
+	ranges := spec
+	if segment, rest, found := strings.Cut(spec, ":"); found {
+		cr.Segment, err = strconv.Atoi(segment)
+		if err != nil || cr.Segment < 1 {
+			return invalid
+		}
+		ranges = rest
+	}
+	from, to, found := strings.Cut(ranges, "-")
+	cr.From, err = strconv.Atoi(from)
+	if err != nil || cr.From < 1 {
+		return invalid
+	}
+	switch {
+	case !found:
+		cr.To = cr.From
+	case to == "":
+		cr.To = 0 // Up to the end of the segment
+	default:
+		cr.To, err = strconv.Atoi(to)
+		if err != nil || cr.To < cr.From {
+			return invalid
+		}
+	}
+	r.Columns = append(r.Columns, cr)
+	return nil
+}
+
+// LoadRules reads a rules file, adding its rules. Each line contains a rule kind (mask or
+// columns) followed by a blank and its value. Empty lines and lines starting with an
+// asterisk or a hash are ignored.
+func (r *Rules) LoadRules(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '*' || text[0] == '#' {
+			continue
+		}
+		kind, value, _ := strings.Cut(text, " ")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(kind) {
+		case RULE_MASK:
+			err = r.AddMask(value)
+		case RULE_COLUMNS, "cols":
+			err = r.AddColumns(value)
+		default:
+			err = fmt.Errorf("unknown rule %s", kind)
+		}
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", fileName, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Apply returns the segments with the ignored parts masked. The column ranges are applied
+// before the masks. A nil Rules returns the segments unchanged.
+func (r *Rules) Apply(segments []string) []string {
+	if r == nil || (len(r.Masks) == 0 && len(r.Columns) == 0) {
+		return segments
+	}
+	masked := make([]string, len(segments))
+	for i, segment := range segments {
+		runes := []rune(segment)
+		for _, cr := range r.Columns {
+			if cr.Segment != 0 && cr.Segment != i+1 {
+				continue
+			}
+			to := cr.To
+			if to == 0 || to > len(runes) {
+				to = len(runes)
+			}
+			for c := cr.From - 1; c < to; c++ {
+				runes[c] = MASK_CHAR
+			}
+		}
+		segment = string(runes)
+		for _, re := range r.Masks {
+			segment = re.ReplaceAllStringFunc(segment, func(s string) string {
+				return strings.Repeat(string(MASK_CHAR), len([]rune(s)))
+			})
+		}
+		masked[i] = segment
+	}
+	return masked
+}
@@ -0,0 +1,327 @@
+package irm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/jguillaumes/ims-injector/internal/codepage"
+)
+
+// A LengthError is returned when the data does not contain the expected number
+// of bytes for a structure, or when its length fields are inconsistent.
+type LengthError struct {
+	Structure string // Structure being deserialized
+	Expected  int    // Number of bytes expected
+	Actual    int    // Number of bytes available
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("invalid %s length. %d bytes expected, %d bytes available", e.Structure, e.Expected, e.Actual)
+}
+
+// An IdentifierError is returned when a structure does not have the expected identifier
+type IdentifierError struct {
+	Structure  string // Structure being deserialized
+	Identifier string // Identifier found in the data
+}
+
+func (e *IdentifierError) Error() string {
+	return fmt.Sprintf("invalid %s identifier %q", e.Structure, e.Identifier)
+}
+
+// A Segment is a message segment (LLZZ + data). The LL value is not kept, since it
+// is always the length of the data plus 4.
+type Segment struct {
+	Flags uint16 // ZZ field
+	Data  []byte
+}
+
+// RSM is the request status message (*REQSTS*) returned by IMS Connect when an error happens
+type RSM struct {
+	Flags   uint16
+	Retcode uint32
+	Rsncode uint32
+}
+
+// CSM is the complete status message (*CSMOKY*) that ends a successful response
+type CSM struct {
+	Flags uint16
+}
+
+// MOD is the segment (*REQMOD*) carrying the MFS MOD name of a response
+type MOD struct {
+	Modname string
+}
+
+// CT is the segment (*CORTKN*) carrying the correlation token of a synchronous callout
+// request, which must be returned with its response
+type CT struct {
+	Token []byte
+}
+
+// Response is a deserialized IMS Connect response. Segments contains the data segments,
+// while the control segments are stored in their own fields (nil if not present).
+type Response struct {
+	Llll     uint32
+	Segments []Segment
+	MOD      *MOD
+	CT       *CT
+	RSM      *RSM
+	CSM      *CSM
+}
+
+// AckRequired checks if the RSM requires an ACK or NAK from the client
+func (r *RSM) AckRequired() bool {
+	return r.Flags&STS_F_ACKREQ != 0
+}
+
+// NowaitAck checks if the ACK to this RSM can be sent with the NOWAIT option
+func (r *RSM) NowaitAck() bool {
+	return r.Flags&STS_F_NOWAIT != 0
+}
+
+// Disconnects checks if IMS Connect closes the socket after sending this RSM, so the
+// error is fatal for the connection and not only for the transaction.
+func (r *RSM) Disconnects() bool {
+	return RSM_DISCONNECT_CODES[r.Retcode]
+}
+
+// AckRequired checks if the CSM requires an ACK or NAK from the client
+func (c *CSM) AckRequired() bool {
+	return c.Flags&STS_F_ACKREQ != 0
+}
+
+// NowaitAck checks if the ACK to this CSM can be sent with the NOWAIT option
+func (c *CSM) NowaitAck() bool {
+	return c.Flags&STS_F_NOWAIT != 0
+}
+
+// DeserializeIRM builds an IRM from its serialized form, including the LLLL total length.
+// The character fields are decoded using the cp codepage (nil means no conversion).
+// The IRM_USER part is read from the IRMs of architecture level 1 or higher, and it is left
+// with its default values for the level 0 ones. The correlation token is only read from the
+// architecture level 2 IRMs.
+func DeserializeIRM(data []byte, cp *codepage.Codepage) (*IRM, error) {
+	if len(data) < 4+IRM_COMMON_LEN {
+		return nil, &LengthError{Structure: "IRM", Expected: 4 + IRM_COMMON_LEN, Actual: len(data)}
+	}
+	irm := NewIRM()
+	irm.Llll = binary.BigEndian.Uint32(data[0:4])
+	irm.Irm_len = binary.BigEndian.Uint16(data[4:6])
+	if int(irm.Irm_len) < IRM_COMMON_LEN {
+		return nil, &LengthError{Structure: "IRM", Expected: IRM_COMMON_LEN, Actual: int(irm.Irm_len)}
+	}
+	if int(irm.Irm_len)+4 > len(data) {
+		return nil, &LengthError{Structure: "IRM", Expected: int(irm.Irm_len) + 4, Actual: len(data)}
+	}
+	if int(irm.Llll) < int(irm.Irm_len)+4 {
+		return nil, &LengthError{Structure: "message", Expected: int(irm.Irm_len) + 4, Actual: int(irm.Llll)}
+	}
+	irm.Irm_arch = data[6]
+	irm.Irm_f0 = data[7]
+	irm.Irm_id = cp.Decode(data[8:16])
+	irm.Irm_nak_rsncode = binary.BigEndian.Uint16(data[16:18])
+	irm.irm_res1 = binary.BigEndian.Uint16(data[18:20])
+	irm.Irm_f5 = data[20]
+	irm.Irm_timer = data[21]
+	irm.Irm_soct = data[22]
+	irm.Irm_es = data[23]
+	irm.Irm_clientid = cp.Decode(data[24:32])
+
+	if irm.Irm_arch != IRM_ARCH_LVL0 && int(irm.Irm_len) >= IRM_COMMON_LEN+IRM_USER_LEN {
+		user, err := DeserializeIRM_USER(data[4+IRM_COMMON_LEN:], cp)
+		if err != nil {
+			return nil, err
+		}
+		irm.Irm_user = *user
+	}
+	ctOffset := 4 + IRM_COMMON_LEN + IRM_USER_LEN
+	if irm.Irm_arch >= IRM_ARCH_LVL2 && int(irm.Irm_len) >= IRM_COMMON_LEN+IRM_USER_LEN+IRM_CT_LEN {
+		irm.Irm_corr_token = append([]byte(nil), data[ctOffset:ctOffset+IRM_CT_LEN]...)
+	}
+	return irm, nil
+}
+
+// DeserializeIRM_USER builds the ARCH 0x01 user part of an IRM from its serialized form.
+// The character fields are decoded using the cp codepage (nil means no conversion).
+// The last field is stored both as reroute name and as alternate client ID, since they
+// are overlaid.
+func DeserializeIRM_USER(data []byte, cp *codepage.Codepage) (*IRM_USER, error) {
+	if len(data) < IRM_USER_LEN {
+		return nil, &LengthError{Structure: "IRM_USER", Expected: IRM_USER_LEN, Actual: len(data)}
+	}
+	field := func(n int) string {
+		return cp.Decode(data[4+n*8 : 12+n*8])
+	}
+	return &IRM_USER{
+		Irm_f1:           data[0],
+		Irm_f2:           data[1],
+		Irm_f3:           data[2],
+		Irm_f4:           data[3],
+		Irm_trncod:       field(0),
+		Irm_imsdestid:    field(1),
+		Irm_lterm:        field(2),
+		Irm_racf_userid:  field(3),
+		Irm_racf_grpname: field(4),
+		Irm_racf_pw:      field(5),
+		Irm_appl_nm:      field(6),
+		Irm_rerout_nm:    field(7),
+		Irm_rt_altcid:    field(7),
+	}, nil
+}
+
+// DeserializeMessage deserializes a complete client message: the IRM and the message
+// segments that follow it, up to the EOM segment or the end of the message.
+func DeserializeMessage(data []byte, cp *codepage.Codepage) (*IRM, []Segment, error) {
+	irm, err := DeserializeIRM(data, cp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if int(irm.Llll) > len(data) {
+		return nil, nil, &LengthError{Structure: "message", Expected: int(irm.Llll), Actual: len(data)}
+	}
+	segments, err := DeserializeSegments(data[4+int(irm.Irm_len) : irm.Llll])
+	if err != nil {
+		return nil, nil, err
+	}
+	return irm, segments, nil
+}
+
+// DeserializeSegments splits data into LLZZ segments. It stops at the end of the
+// data or when an EOM segment (LL=4) is found.
+func DeserializeSegments(data []byte) ([]Segment, error) {
+	segments := make([]Segment, 0, 4)
+	for len(data) > 0 {
+		if len(data) < SEGHDR_LEN {
+			return nil, &LengthError{Structure: "segment", Expected: SEGHDR_LEN, Actual: len(data)}
+		}
+		ll := int(binary.BigEndian.Uint16(data[0:2]))
+		zz := binary.BigEndian.Uint16(data[2:4])
+		if ll < SEGHDR_LEN || ll > len(data) {
+			return nil, &LengthError{Structure: "segment", Expected: ll, Actual: len(data)}
+		}
+		if ll == SEGHDR_LEN {
+			break // EOM
+		}
+		segments = append(segments, Segment{Flags: zz, Data: data[SEGHDR_LEN:ll]})
+		data = data[ll:]
+	}
+	return segments, nil
+}
+
+// ControlIdentifier returns the identifier of a control segment (RSM_ID, CSM_ID, MOD_ID or CT_ID)
+// or an empty string if seg is a data segment.
+func ControlIdentifier(seg Segment, cp *codepage.Codepage) string {
+	if len(seg.Data) < 8 {
+		return ""
+	}
+	id := cp.Decode(seg.Data[:8])
+	switch id {
+	case RSM_ID, CSM_ID, MOD_ID, CT_ID:
+		return id
+	default:
+		return ""
+	}
+}
+
+// ParseRSM builds an RSM from a *REQSTS* segment
+func ParseRSM(seg Segment, cp *codepage.Codepage) (*RSM, error) {
+	err := checkControl(seg, RSM_ID, RSM_LEN, cp)
+	if err != nil {
+		return nil, err
+	}
+	return &RSM{
+		Flags:   seg.Flags,
+		Retcode: binary.BigEndian.Uint32(seg.Data[8:12]),
+		Rsncode: binary.BigEndian.Uint32(seg.Data[12:16]),
+	}, nil
+}
+
+// ParseCSM builds a CSM from a *CSMOKY* segment
+func ParseCSM(seg Segment, cp *codepage.Codepage) (*CSM, error) {
+	err := checkControl(seg, CSM_ID, CSM_LEN, cp)
+	if err != nil {
+		return nil, err
+	}
+	return &CSM{Flags: seg.Flags}, nil
+}
+
+// ParseMOD builds a MOD from a *REQMOD* segment
+func ParseMOD(seg Segment, cp *codepage.Codepage) (*MOD, error) {
+	err := checkControl(seg, MOD_ID, MOD_LEN, cp)
+	if err != nil {
+		return nil, err
+	}
+	return &MOD{Modname: strings.TrimRight(cp.Decode(seg.Data[8:16]), " ")}, nil
+}
+
+// ParseCT builds a CT from a *CORTKN* segment. The token is copied, so it can be kept
+// after the buffer is reused.
+func ParseCT(seg Segment, cp *codepage.Codepage) (*CT, error) {
+	err := checkControl(seg, CT_ID, CT_LEN, cp)
+	if err != nil {
+		return nil, err
+	}
+	return &CT{Token: append([]byte(nil), seg.Data[8:8+IRM_CT_LEN]...)}, nil
+}
+
+// DeserializeResponse parses a complete IMS Connect response, including the LLLL total length.
+// The control segments are decoded using the cp codepage (nil means no conversion), while the
+// data segments are kept as they are received.
+func DeserializeResponse(data []byte, cp *codepage.Codepage) (*Response, error) {
+	if len(data) < 4 {
+		return nil, &LengthError{Structure: "response", Expected: 4, Actual: len(data)}
+	}
+	resp := &Response{
+		Llll: binary.BigEndian.Uint32(data[0:4]),
+	}
+	if resp.Llll < 4 || int(resp.Llll) > len(data) {
+		return nil, &LengthError{Structure: "response", Expected: int(resp.Llll), Actual: len(data)}
+	}
+	segments, err := DeserializeSegments(data[4:resp.Llll])
+	if err != nil {
+		return nil, err
+	}
+	resp.Segments = make([]Segment, 0, len(segments))
+	for _, seg := range segments {
+		switch ControlIdentifier(seg, cp) {
+		case RSM_ID:
+			resp.RSM, err = ParseRSM(seg, cp)
+		case CSM_ID:
+			resp.CSM, err = ParseCSM(seg, cp)
+		case MOD_ID:
+			resp.MOD, err = ParseMOD(seg, cp)
+		case CT_ID:
+			resp.CT, err = ParseCT(seg, cp)
+		default:
+			resp.Segments = append(resp.Segments, seg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// AckRequired checks if the response requires an ACK or NAK from the client
+func (r *Response) AckRequired() bool {
+	return (r.RSM != nil && r.RSM.AckRequired()) || (r.CSM != nil && r.CSM.AckRequired())
+}
+
+// NowaitAck checks if the ACK to the response can be sent with the NOWAIT option
+func (r *Response) NowaitAck() bool {
+	return (r.RSM != nil && r.RSM.NowaitAck()) || (r.CSM != nil && r.CSM.NowaitAck())
+}
+
+// checkControl validates the identifier and length of a control segment
+func checkControl(seg Segment, id string, length int, cp *codepage.Codepage) error {
+	if len(seg.Data)+SEGHDR_LEN < length {
+		return &LengthError{Structure: id, Expected: length, Actual: len(seg.Data) + SEGHDR_LEN}
+	}
+	found := cp.Decode(seg.Data[:8])
+	if found != id {
+		return &IdentifierError{Structure: id, Identifier: found}
+	}
+	return nil
+}
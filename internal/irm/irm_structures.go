@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+
+	"github.com/jguillaumes/ims-injector/internal/codepage"
 )
 
 // +
@@ -24,6 +26,7 @@ type IRM struct {
 	Irm_es          uint8
 	Irm_clientid    string
 	Irm_user        IRM_USER
+	Irm_corr_token  []byte // ARCH 0x02 correlation token, sent with the synchronous callout responses
 }
 
 // +
@@ -83,7 +86,8 @@ func NewIRM_USER() *IRM_USER {
 }
 
 // Serialize IRM_USER into a provided byte slice, checking for sufficient length
-func (u *IRM_USER) Serialize(buf *bytes.Buffer) error {
+// The character fields are converted using the cp codepage (nil means no conversion)
+func (u *IRM_USER) Serialize(buf *bytes.Buffer, cp *codepage.Codepage) error {
 	if buf.Available() < 76 {
 		return fmt.Errorf("buffer too small for IRM_USER serialization. %d bytes required, %d bytes provided", 76, buf.Available())
 	}
@@ -92,17 +96,26 @@ func (u *IRM_USER) Serialize(buf *bytes.Buffer) error {
 	buf.WriteByte(u.Irm_f2)
 	buf.WriteByte(u.Irm_f3)
 	buf.WriteByte(u.Irm_f4)
-	buf.WriteString(fmt.Sprintf("%-8s", u.Irm_trncod))
-	buf.WriteString(fmt.Sprintf("%-8s", u.Irm_imsdestid))
-	buf.WriteString(fmt.Sprintf("%-8s", u.Irm_lterm))
-	buf.WriteString(fmt.Sprintf("%-8s", u.Irm_racf_userid))
-	buf.WriteString(fmt.Sprintf("%-8s", u.Irm_racf_grpname))
-	buf.WriteString(fmt.Sprintf("%-8s", u.Irm_racf_pw))
-	buf.WriteString(fmt.Sprintf("%-8s", u.Irm_appl_nm))
+
+	reroute := u.Irm_rt_altcid
 	if u.Irm_rerout_nm != "        " {
-		buf.WriteString(fmt.Sprintf("%-8s", u.Irm_rerout_nm))
-	} else {
-		buf.WriteString(fmt.Sprintf("%-8s", u.Irm_rt_altcid))
+		reroute = u.Irm_rerout_nm
+	}
+	fields := []string{
+		u.Irm_trncod,
+		u.Irm_imsdestid,
+		u.Irm_lterm,
+		u.Irm_racf_userid,
+		u.Irm_racf_grpname,
+		u.Irm_racf_pw,
+		u.Irm_appl_nm,
+		reroute,
+	}
+	for _, field := range fields {
+		err := writeField(buf, field, cp)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -110,7 +123,8 @@ func (u *IRM_USER) Serialize(buf *bytes.Buffer) error {
 
 // Serialize IRM into a provided byte buffer, checking for sufficient length
 // The numbers must be serialized in big-endian order
-func (irm *IRM) Serialize(buf *bytes.Buffer) error {
+// The character fields are converted using the cp codepage (nil means no conversion)
+func (irm *IRM) Serialize(buf *bytes.Buffer, cp *codepage.Codepage) error {
 	if buf.Available() < 108 { // 32 + 76 = 108 bytes
 		return fmt.Errorf("buffer too small for IRM serialization. %d bytes required, %d bytes provided", 108, buf.Available())
 	}
@@ -126,10 +140,14 @@ func (irm *IRM) Serialize(buf *bytes.Buffer) error {
 
 	buf.WriteByte(irm.Irm_arch)
 	buf.WriteByte(irm.Irm_f0)
-	buf.WriteString(fmt.Sprintf("%-8s", irm.Irm_id))
+	err := writeField(buf, irm.Irm_id, cp)
+	if err != nil {
+		return err
+	}
 
-	buf.WriteByte(0) // nak_rsncode high byte
-	buf.WriteByte(0) // nak_rsncode low byte
+	nak_be := make([]byte, 2)
+	binary.BigEndian.PutUint16(nak_be, irm.Irm_nak_rsncode)
+	buf.Write(nak_be)
 
 	buf.WriteByte(0) // irm_res1 high byte
 	buf.WriteByte(0) // irm_res1 low byte
@@ -139,7 +157,131 @@ func (irm *IRM) Serialize(buf *bytes.Buffer) error {
 	buf.WriteByte(irm.Irm_soct)
 	buf.WriteByte(irm.Irm_es)
 
-	buf.WriteString(fmt.Sprintf("%-8s", irm.Irm_clientid))
+	err = writeField(buf, irm.Irm_clientid, cp)
+	if err != nil {
+		return err
+	}
+
+	err = irm.Irm_user.Serialize(buf, cp)
+	if err != nil || irm.Irm_arch < IRM_ARCH_LVL2 {
+		return err
+	}
+	// The correlation token is binary, so it is not converted
+	token := make([]byte, IRM_CT_LEN)
+	copy(token, irm.Irm_corr_token)
+	buf.Write(token)
+	return nil
+}
+
+// writeField writes a character field, padded with blanks to 8 characters
+func writeField(buf *bytes.Buffer, field string, cp *codepage.Codepage) error {
+	data, err := cp.Encode(fmt.Sprintf("%-8s", field))
+	if err != nil {
+		return fmt.Errorf("invalid IRM field %q: %v", field, err)
+	}
+	buf.Write(data)
+	return nil
+}
+
+// Serialize writes a data segment (LLZZ + data) into a provided byte buffer
+func (s *Segment) Serialize(buf *bytes.Buffer) {
+	ll_be := make([]byte, 2)
+	binary.BigEndian.PutUint16(ll_be, uint16(len(s.Data)+SEGHDR_LEN))
+	buf.Write(ll_be)
+	zz_be := make([]byte, 2)
+	binary.BigEndian.PutUint16(zz_be, s.Flags)
+	buf.Write(zz_be)
+	buf.Write(s.Data)
+}
+
+// Serialize writes a *REQSTS* segment into a provided byte buffer
+func (r *RSM) Serialize(buf *bytes.Buffer, cp *codepage.Codepage) error {
+	data := make([]byte, 0, RSM_LEN-SEGHDR_LEN)
+	id, err := cp.Encode(RSM_ID)
+	if err != nil {
+		return err
+	}
+	data = append(data, id...)
+	data = binary.BigEndian.AppendUint32(data, r.Retcode)
+	data = binary.BigEndian.AppendUint32(data, r.Rsncode)
+	seg := Segment{Flags: r.Flags, Data: data}
+	seg.Serialize(buf)
+	return nil
+}
+
+// Serialize writes a *CSMOKY* segment into a provided byte buffer
+func (c *CSM) Serialize(buf *bytes.Buffer, cp *codepage.Codepage) error {
+	id, err := cp.Encode(CSM_ID)
+	if err != nil {
+		return err
+	}
+	seg := Segment{Flags: c.Flags, Data: id}
+	seg.Serialize(buf)
+	return nil
+}
 
-	return irm.Irm_user.Serialize(buf)
+// Serialize writes a *REQMOD* segment into a provided byte buffer
+func (m *MOD) Serialize(buf *bytes.Buffer, cp *codepage.Codepage) error {
+	data, err := cp.Encode(fmt.Sprintf("%-8s%-8s", MOD_ID, m.Modname))
+	if err != nil {
+		return err
+	}
+	seg := Segment{Flags: 0, Data: data}
+	seg.Serialize(buf)
+	return nil
+}
+
+// Serialize writes a *CORTKN* segment into a provided byte buffer
+func (t *CT) Serialize(buf *bytes.Buffer, cp *codepage.Codepage) error {
+	id, err := cp.Encode(CT_ID)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, CT_LEN-SEGHDR_LEN)
+	copy(data, id)
+	copy(data[len(id):], t.Token)
+	seg := Segment{Flags: 0, Data: data}
+	seg.Serialize(buf)
+	return nil
+}
+
+// Serialize writes a complete IMS Connect response into a provided byte buffer: the LLLL
+// total length, the MOD segment, the data segments, the correlation token and the RSM or
+// CSM status segment.
+// The Llll field is updated with the actual length.
+func (r *Response) Serialize(buf *bytes.Buffer, cp *codepage.Codepage) error {
+	body := new(bytes.Buffer)
+	if r.MOD != nil {
+		err := r.MOD.Serialize(body, cp)
+		if err != nil {
+			return err
+		}
+	}
+	for _, seg := range r.Segments {
+		seg.Serialize(body)
+	}
+	if r.CT != nil {
+		err := r.CT.Serialize(body, cp)
+		if err != nil {
+			return err
+		}
+	}
+	if r.RSM != nil {
+		err := r.RSM.Serialize(body, cp)
+		if err != nil {
+			return err
+		}
+	}
+	if r.CSM != nil {
+		err := r.CSM.Serialize(body, cp)
+		if err != nil {
+			return err
+		}
+	}
+	r.Llll = uint32(body.Len() + 4)
+	llll_be := make([]byte, 4)
+	binary.BigEndian.PutUint32(llll_be, r.Llll)
+	buf.Write(llll_be)
+	buf.Write(body.Bytes())
+	return nil
 }
@@ -0,0 +1,221 @@
+package irm
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/codepage"
+)
+
+func TestIRMRoundTrip(t *testing.T) {
+	ebcdic, err := codepage.Lookup("037")
+	if err != nil {
+		t.Fatalf("Lookup(037): %v", err)
+	}
+	token := bytes.Repeat([]byte{0xC1, 0x00}, IRM_CT_LEN/2)
+
+	tests := []struct {
+		name  string
+		arch  uint8
+		token []byte
+		cp    *codepage.Codepage
+	}{
+		{"level 0", IRM_ARCH_LVL0, nil, nil},
+		{"level 1", IRM_ARCH_LVL1, nil, nil},
+		{"level 1 EBCDIC", IRM_ARCH_LVL1, nil, ebcdic},
+		{"level 2", IRM_ARCH_LVL2, token, nil},
+		{"level 2 EBCDIC", IRM_ARCH_LVL2, token, ebcdic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := NewIRM()
+			in.Irm_arch = tt.arch
+			in.Irm_f0 = IRM_F0_SYNCNAK | IRM_F0_NAKRSN
+			in.Irm_nak_rsncode = 0x1234
+			in.Irm_timer = TimerValue(5 * time.Second)
+			in.Irm_clientid = "CLIENT01"
+			in.Irm_user.Irm_f2 = IRM_F2_CM1
+			in.Irm_user.Irm_f4 = IRM_F4_SENDONLY
+			in.Irm_user.Irm_trncod = "IVTNO   "
+			in.Irm_user.Irm_imsdestid = "IMS1    "
+			in.Irm_user.Irm_racf_userid = "USER01  "
+			in.Irm_corr_token = tt.token
+			switch tt.arch {
+			case IRM_ARCH_LVL0:
+				in.Irm_len = IRM_COMMON_LEN
+			case IRM_ARCH_LVL2:
+				in.Irm_len = IRM_COMMON_LEN + IRM_USER_LEN + IRM_CT_LEN
+			}
+			in.Llll = 4 + uint32(in.Irm_len)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 256))
+			err := in.Serialize(buf, tt.cp)
+			if err != nil {
+				t.Fatalf("Serialize: %v", err)
+			}
+			if tt.cp != nil && !IsEBCDIC(buf.Bytes()) {
+				t.Errorf("IsEBCDIC = false for an IRM serialized with %s", tt.cp.Name)
+			}
+			out, err := DeserializeIRM(buf.Bytes(), tt.cp)
+			if err != nil {
+				t.Fatalf("DeserializeIRM: %v", err)
+			}
+
+			want := *in
+			if tt.arch == IRM_ARCH_LVL0 {
+				// The user part is not read from the level 0 IRMs
+				want.Irm_user = *NewIRM_USER()
+			}
+			if !reflect.DeepEqual(*out, want) {
+				t.Errorf("DeserializeIRM =\n%+v\nwant\n%+v", *out, want)
+			}
+		})
+	}
+}
+
+func TestDeserializeIRMLengthErrors(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 256))
+	err := NewIRM().Serialize(buf, nil)
+	if err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+	data := buf.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"common part truncated", data[:4+IRM_COMMON_LEN-1]},
+		{"user part truncated", data[:len(data)-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DeserializeIRM(tt.data, nil)
+			var lengthErr *LengthError
+			if !errors.As(err, &lengthErr) {
+				t.Errorf("DeserializeIRM error = %v, want a *LengthError", err)
+			}
+		})
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	ebcdic, err := codepage.Lookup("1140")
+	if err != nil {
+		t.Fatalf("Lookup(1140): %v", err)
+	}
+
+	tests := []struct {
+		name string
+		resp Response
+		cp   *codepage.Codepage
+	}{
+		{
+			name: "segments and CSM",
+			resp: Response{
+				Segments: []Segment{{Data: []byte("LINE 1")}, {Data: []byte("LINE 2")}},
+				MOD:      &MOD{Modname: "JGPMOD1"},
+				CSM:      &CSM{Flags: STS_F_ACKREQ},
+			},
+		},
+		{
+			name: "RSM",
+			resp: Response{
+				Segments: []Segment{},
+				RSM:      &RSM{Retcode: 0x0C, Rsncode: 0x08},
+			},
+			cp: ebcdic,
+		},
+		{
+			name: "callout request",
+			resp: Response{
+				Segments: []Segment{{Data: []byte("REQUEST")}},
+				CT:       &CT{Token: bytes.Repeat([]byte{0x01}, IRM_CT_LEN)},
+				CSM:      &CSM{},
+			},
+			cp: ebcdic,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			err := tt.resp.Serialize(buf, tt.cp)
+			if err != nil {
+				t.Fatalf("Serialize: %v", err)
+			}
+			if int(tt.resp.Llll) != buf.Len() {
+				t.Errorf("Llll = %d, want %d", tt.resp.Llll, buf.Len())
+			}
+			out, err := DeserializeResponse(buf.Bytes(), tt.cp)
+			if err != nil {
+				t.Fatalf("DeserializeResponse: %v", err)
+			}
+			if !reflect.DeepEqual(*out, tt.resp) {
+				t.Errorf("DeserializeResponse =\n%+v\nwant\n%+v", *out, tt.resp)
+			}
+		})
+	}
+}
+
+func TestTimerDuration(t *testing.T) {
+	tests := []struct {
+		timer uint8
+		want  time.Duration
+	}{
+		{IRM_TIMER_DEFAULT, 0},
+		{0x01, 10 * time.Millisecond},
+		{0x19, 250 * time.Millisecond},
+		{0x1A, 300 * time.Millisecond},
+		{0x1E, 500 * time.Millisecond},
+		{0x27, 950 * time.Millisecond},
+		{0x28, time.Second},
+		{0x63, time.Minute},
+		{0x64, time.Minute},
+		{0x9F, time.Hour},
+		{0xA0, 0},
+		{IRM_TIMER_NOWAIT, 0},
+	}
+	for _, tt := range tests {
+		got := TimerDuration(tt.timer)
+		if got != tt.want {
+			t.Errorf("TimerDuration(%#02x) = %v, want %v", tt.timer, got, tt.want)
+		}
+	}
+}
+
+func TestTimerValue(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want uint8
+	}{
+		{-time.Second, IRM_TIMER_DEFAULT},
+		{0, IRM_TIMER_DEFAULT},
+		{time.Millisecond, 0x01},
+		{10 * time.Millisecond, 0x01},
+		{11 * time.Millisecond, 0x02},
+		{250 * time.Millisecond, 0x19},
+		{260 * time.Millisecond, 0x1A},
+		{500 * time.Millisecond, 0x1E},
+		{950 * time.Millisecond, 0x27},
+		{951 * time.Millisecond, 0x28},
+		{10 * time.Second, 0x31},
+		{time.Minute, 0x63},
+		{61 * time.Second, 0x65},
+		{time.Hour, 0x9F},
+		{2 * time.Hour, 0x9F},
+	}
+	for _, tt := range tests {
+		got := TimerValue(tt.d)
+		if got != tt.want {
+			t.Errorf("TimerValue(%v) = %#02x, want %#02x", tt.d, got, tt.want)
+		}
+		// The value represents at least the requested interval
+		if tt.d > 0 && tt.d <= time.Hour && TimerDuration(got) < tt.d {
+			t.Errorf("TimerDuration(TimerValue(%v)) = %v, shorter than the interval", tt.d, TimerDuration(got))
+		}
+	}
+}
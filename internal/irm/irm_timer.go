@@ -0,0 +1,65 @@
+package irm
+
+import "time"
+
+// IRM_TIMER special values
+const (
+	IRM_TIMER_DEFAULT = 0x00 // Use the IMS Connect default timeout
+	IRM_TIMER_NOWAIT  = 0xE9 // Do not wait (ACK/NAK with NOWAIT)
+)
+
+// TimerDuration converts an IRM_TIMER value into the time interval it represents
+//
+// See the IRM_TIMER description in the IMS Communications and Connections manual:
+//
+//	X'01'-X'19'  0.01 to 0.25 seconds, in 0.01 seconds increments
+//	X'1A'-X'27'  0.30 to 0.95 seconds, in 0.05 seconds increments
+//	X'28'-X'63'  1 to 60 seconds, in 1 second increments
+//	X'64'-X'9F'  1 to 60 minutes, in 1 minute increments
+//
+// A zero duration is returned for the default, the no wait and the invalid values.
+func TimerDuration(timer uint8) time.Duration {
+	switch {
+	case timer >= 0x01 && timer <= 0x19:
+		return time.Duration(timer) * 10 * time.Millisecond
+	case timer >= 0x1A && timer <= 0x27:
+		return 300*time.Millisecond + time.Duration(timer-0x1A)*50*time.Millisecond
+	case timer >= 0x28 && timer <= 0x63:
+		return time.Duration(timer-0x27) * time.Second
+	case timer >= 0x64 && timer <= 0x9F:
+		return time.Duration(timer-0x63) * time.Minute
+	default:
+		return 0
+	}
+}
+
+// TimerValue converts a time interval into the IRM_TIMER value that represents it, rounding
+// it up to the next available value. Intervals longer than one hour use the maximum value,
+// and zero or negative intervals use the IMS Connect default.
+func TimerValue(d time.Duration) uint8 {
+	steps := func(d time.Duration, unit time.Duration) uint8 {
+		return uint8((d + unit - 1) / unit)
+	}
+	switch {
+	case d <= 0:
+		return IRM_TIMER_DEFAULT
+	case d <= 250*time.Millisecond:
+		return steps(d, 10*time.Millisecond)
+	case d <= 300*time.Millisecond:
+		return 0x1A
+	case d <= 950*time.Millisecond:
+		return 0x1A + steps(d-300*time.Millisecond, 50*time.Millisecond)
+	case d <= time.Minute:
+		return 0x27 + steps(d, time.Second)
+	case d <= time.Hour:
+		return 0x63 + steps(d, time.Minute)
+	default:
+		return 0x9F
+	}
+}
+
+// IsEBCDIC checks if a serialized IRM has been built in EBCDIC, looking at the first
+// character of the IRM identifier ('*' is X'5C' in EBCDIC and X'2A' in ASCII)
+func IsEBCDIC(data []byte) bool {
+	return len(data) > 8 && data[8] == 0x5C
+}
@@ -4,6 +4,7 @@ package irm
 const (
 	IRM_ARCH_LVL0 = 0x00 // Architecture level 0
 	IRM_ARCH_LVL1 = 0x01 // Architecture level 1
+	IRM_ARCH_LVL2 = 0x02 // Architecture level 2: correlation token after the user part
 )
 
 // Values for F0
@@ -71,3 +72,50 @@ const (
 	IRM_F4_SENDONLY = uint8('S') // Send-only message
 	IRM_F4_SENDREC  = uint8(' ') // Send-and-receive message
 )
+
+// Values for IRM_F5 (RESUME TPIPE options)
+const (
+	IRM_F5_NOAUTO = 0x01 // Return the messages already queued, ACKing each one to get the next
+	IRM_F5_ONEMSG = 0x02 // Return a single message
+	IRM_F5_AUTO   = 0x04 // Return the queued messages and the new ones as they arrive
+	IRM_F5_SNGLWT = 0x08 // Return a single message, waiting for it to arrive
+)
+
+// Identifiers of the control segments returned by IMS Connect
+const (
+	RSM_ID = "*REQSTS*" // Request status message
+	CSM_ID = "*CSMOKY*" // Complete status message
+	MOD_ID = "*REQMOD*" // MFS MOD name
+	CT_ID  = "*CORTKN*" // Correlation token of a synchronous callout request
+)
+
+// Values for the flags (ZZ) of the RSM and CSM status segments
+const (
+	STS_F_ACKREQ = 0x2000 // An ACK or NAK is required from the client
+	STS_F_NOWAIT = 0x0002 // The ACK can be sent using the NOWAIT option
+)
+
+// RSM return codes after which IMS Connect disconnects the socket. The other return
+// codes only affect the transaction, and the socket can still be used.
+var RSM_DISCONNECT_CODES = map[uint32]bool{
+	0x0004: true, // Exit request error
+	0x0008: true, // Error detected by IMS Connect
+	0x000C: true, // Error returned by OTMA
+	0x0010: true, // Error returned by OTMA with a sense code
+	0x0018: true, // SCI error
+	0x001C: true, // OM error
+	0x0020: true, // IRM_TIMER expired
+	0x0024: true, // Default IRM_TIMER expired
+}
+
+// Lengths of the IRM structures and control segments
+const (
+	IRM_COMMON_LEN = 28 // IRM common part, including the LL field
+	IRM_USER_LEN   = 68 // ARCH 0x01 user part
+	IRM_CT_LEN     = 40 // ARCH 0x02 correlation token
+	SEGHDR_LEN     = 4  // Segment LLZZ
+	RSM_LEN        = 20 // LLZZ + identifier + return code + reason code
+	CSM_LEN        = 12 // LLZZ + identifier
+	MOD_LEN        = 20 // LLZZ + identifier + MOD name
+	CT_LEN         = 52 // LLZZ + identifier + correlation token
+)
@@ -0,0 +1,91 @@
+package irm_net
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/imsconnect"
+	"github.com/jguillaumes/ims-injector/internal/assertions"
+)
+
+// Modes to reject the outputs with a NAK, when IMS Connect asks to confirm them
+const (
+	NAK_NONE   = "none"   // ACK all the outputs
+	NAK_ALL    = "all"    // NAK all the outputs
+	NAK_FAILED = "failed" // NAK the outputs not meeting the expectation of the transaction
+)
+
+// ValidNakMode checks if a string is one of the NAK modes
+func ValidNakMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case NAK_NONE, NAK_ALL, NAK_FAILED:
+		return true
+	}
+	return false
+}
+
+// Transaction is a message to be sent to IMS, as read from the input file
+type Transaction struct {
+	Line      int                     // Line number in the input file
+	Iteration int                     // Iteration over the input file, starting at 1
+	Text      string                  // Transaction code followed by the message text
+	Segments  []string                // Message segments. If empty, Text is sent as a single segment
+	Overrides *imsconnect.Overrides   // IRM values for this transaction only (nil to use the template)
+	Expect    *assertions.Expectation // Checks to be done on the response (nil if there are none)
+	Nak       string                  // NAK mode for the output (empty is the same as NAK_NONE)
+
+	// A conversation is a sequence of steps sent through the same socket, so the IMS
+	// conversational transactions keep their SPA between the steps. The Transaction of a
+	// conversation only has Line, Iteration and Steps, and each step is a Transaction with
+	// the line of its conversation and its position in it.
+	Steps        []Transaction // Steps of the conversation (empty for a single transaction)
+	Conversation int           // Input line of the conversation of a step (0 if it is not a step)
+	Step         int           // Position of the step in its conversation, starting at 1
+}
+
+// IsConversation checks if the transaction is a conversation
+func (t *Transaction) IsConversation() bool {
+	return len(t.Steps) > 0
+}
+
+// Result is the outcome of a transaction, sent by Do_interaction for every
+// transaction it processes, successful or not. The Result of a conversation groups the
+// results of its steps.
+type Result struct {
+	Transaction Transaction
+	Trancode    string            // Transaction code, without padding
+	Segments    []string          // Response segments
+	Modname     string            // MOD name, if returned by IMS
+	RSM         *imsconnect.RSM   // Request status message, if returned by IMS Connect
+	ClientId    string            // Client ID used to send the transaction
+	Worker      int               // Number of the interaction goroutine
+	Start       time.Time         // Time the transaction was sent (the last time, if it was retried)
+	Timing      imsconnect.Timing // Time spent in each phase of the interaction, for the last attempt
+	Attempts    int               // Number of times the transaction was sent
+	Err         error             // Error that made the transaction fail
+	Failures    []string          // Failed checks of the expectation, if the transaction has one
+	Nak         bool              // The output was rejected with a NAK
+	SendOnly    bool              // The transaction was sent as a send-only message, without output
+	Steps       []Result          // Results of the steps of a conversation, in order
+}
+
+// OK checks if the transaction got a response without errors. The send-only messages
+// have no response, so they are OK if they were sent without errors. A conversation is
+// OK if all its steps are.
+func (r *Result) OK() bool {
+	if len(r.Steps) > 0 {
+		for i := range r.Steps {
+			if !r.Steps[i].OK() {
+				return false
+			}
+		}
+		return r.Err == nil
+	}
+	return r.Err == nil && (r.SendOnly || len(r.Segments) > 0)
+}
+
+// Passed checks if the transaction got a response meeting its expectation. It is only
+// meaningful if the transaction has one.
+func (r *Result) Passed() bool {
+	return r.OK() && len(r.Failures) == 0
+}
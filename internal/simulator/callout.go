@@ -0,0 +1,131 @@
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/codepage"
+	"github.com/jguillaumes/ims-injector/internal/irm"
+	log "github.com/sirupsen/logrus"
+)
+
+// calloutCall is a synchronous callout request sent by a simulated ICAL call, waiting
+// for the response of the callout server
+type calloutCall struct {
+	token []byte              // Correlation token, returned with the response
+	reply chan *calloutResult // Gets the response (buffered)
+}
+
+// calloutResult is the answer of the callout server to a request
+type calloutResult struct {
+	segments []string
+	nak      bool   // The request was rejected
+	reason   uint16 // NAK reason code
+}
+
+// newCallout registers a new synchronous callout request, with a unique correlation token
+func (s *Server) newCallout(tpipe string) *calloutCall {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextToken++
+	// The token is opaque for the clients: IMS ID, TPIPE and a sequence number
+	token := fmt.Sprintf("%-8s%-8s%024d", "IMSSIM", tpipe, s.nextToken)
+	call := &calloutCall{token: []byte(token), reply: make(chan *calloutResult, 1)}
+	s.callouts[token] = call
+	return call
+}
+
+// answerCallout delivers the response to the request with the given correlation token.
+// It returns false if there is no such request, because its ICAL call has timed out.
+func (s *Server) answerCallout(token []byte, result *calloutResult) bool {
+	s.lock.Lock()
+	call, ok := s.callouts[string(token)]
+	delete(s.callouts, string(token))
+	s.lock.Unlock()
+	if ok {
+		call.reply <- result
+	}
+	return ok
+}
+
+// callout sends the input of a transaction, without the transaction code, as a synchronous
+// callout request to the TPIPE of a callout rule and waits up to timeout for the response,
+// as the ICAL call of an IMS application would. It returns the output of the transaction,
+// which is the response or an error message if there is no response or the request is
+// rejected. It returns false if there is no response in time and the timeout is the IRM
+// timer, so the transaction times out.
+func (c *connection) callout(rule *Rule, segments []irm.Segment, timeout time.Duration, cp *codepage.Codepage) ([]string, bool) {
+	tpipe := strings.ToUpper(strings.TrimSpace(rule.TPIPE))
+	msg := &heldMessage{call: c.server.newCallout(tpipe)}
+	for n, seg := range segments {
+		text := cp.Decode(seg.Data)
+		if n == 0 {
+			_, text, _ = strings.Cut(strings.TrimLeft(text, " "), " ")
+			if text == "" {
+				continue
+			}
+		}
+		msg.segments = append(msg.segments, text)
+	}
+	c.server.queues.put(tpipe, msg)
+	log.Infof("Client %s: callout request queued to TPIPE %s", c.clientId, tpipe)
+
+	var result *calloutResult
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result = <-msg.call.reply:
+	case <-timer.C:
+		c.server.queues.remove(tpipe, msg)
+		if !c.server.answerCallout(msg.call.token, nil) {
+			// The response arrived meanwhile
+			result = <-msg.call.reply
+		}
+	}
+
+	switch {
+	case result == nil && timeout < rule.calloutTimeout():
+		return nil, false
+	case result == nil:
+		log.Infof("Client %s: no response to the callout request from TPIPE %s", c.clientId, tpipe)
+		return []string{fmt.Sprintf("ICAL ERROR: NO RESPONSE FROM %s AFTER %v", tpipe, timeout)}, true
+	case result.nak:
+		log.Infof("Client %s: callout request rejected, reason %d", c.clientId, result.reason)
+		return []string{fmt.Sprintf("ICAL ERROR: REQUEST REJECTED BY %s, REASON %d", tpipe, result.reason)}, true
+	default:
+		log.Infof("Client %s: callout response received, %d segments", c.clientId, len(result.segments))
+		return result.segments, true
+	}
+}
+
+// calloutResponse handles a synchronous callout response. If the request is the message
+// waiting for its ACK on the connection, the response also acknowledges it, and the
+// RESUME TPIPE flow goes on as after an ACK. A response arriving after its ICAL call
+// timed out is discarded.
+func (c *connection) calloutResponse(req *irm.IRM, segments []irm.Segment, cp *codepage.Codepage) (*irm.Response, bool) {
+	token := req.Irm_corr_token
+	if token == nil {
+		log.Warnf("Client %s sent a callout response without correlation token", c.clientId)
+		return rsmResponse(0x0008, 0x0039)
+	}
+	result := &calloutResult{}
+	for _, seg := range segments {
+		result.segments = append(result.segments, cp.Decode(seg.Data))
+	}
+	if !c.server.answerCallout(token, result) {
+		log.Infof("Client %s: callout response discarded, the ICAL call timed out", c.clientId)
+	}
+
+	state := c.resumeState
+	if !c.pendingAck || state == nil || state.pending == nil || state.pending.call == nil || !bytes.Equal(state.pending.call.token, token) {
+		return nil, false
+	}
+	c.pendingAck = false
+	resp, disconnect, handled := c.resumeAck(req, cp)
+	if handled {
+		return resp, disconnect
+	}
+	return c.noMoreOutput(req)
+}
@@ -0,0 +1,165 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Responder types
+const (
+	RULE_ECHO    = "echo"    // Return the input segments
+	RULE_STATIC  = "static"  // Return a fixed list of segments
+	RULE_ERROR   = "error"   // Return an RSM with the given return and reason codes
+	RULE_CALLOUT = "callout" // Send the input as a synchronous callout request and return its response
+)
+
+// Default time the callout rules wait for the response of the callout server
+const DEFAULT_CALLOUT_TIMEOUT = 10 * time.Second
+
+// A Rule describes how the simulator answers a transaction
+type Rule struct {
+	Type     string   `json:"type"`     // echo, static, error or callout
+	Segments []string `json:"segments"` // Response segments for static rules
+	Modname  string   `json:"modname"`  // MOD name returned if the client requests it
+	Delay    Duration `json:"delay"`    // Time to wait before answering
+	Retcode  Code     `json:"retcode"`  // RSM return code for error rules
+	Reason   Code     `json:"reason"`   // RSM reason code for error rules
+	TPIPE    string   `json:"tpipe"`    // TPIPE whose hold queue also gets the output, for RESUME TPIPE, or gets the callout requests
+	Timeout  Duration `json:"timeout"`  // Time the callout rules wait for the response (default 10s)
+
+	// The transaction is conversational: it starts a conversation, and the next messages
+	// of the connection are routed to it until the client deallocates the conversation
+	Conversation bool `json:"conversation"`
+}
+
+// Rules routes transaction codes to responders. Transactions without a specific
+// rule use the default one, or are echoed if there is no default.
+type Rules struct {
+	Default      *Rule            `json:"default"`
+	Transactions map[string]*Rule `json:"transactions"`
+}
+
+// Duration is a time.Duration that can be read from JSON as a string ("250ms", "2s")
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("durations must be specified as strings (\"250ms\", \"2s\"): %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Code is a return or reason code that can be read from JSON as a number or as a
+// string, allowing hexadecimal values ("0x0C")
+type Code uint32
+
+func (c *Code) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), "\"")
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid code %s: %v", string(data), err)
+	}
+	*c = Code(v)
+	return nil
+}
+
+// DefaultRules returns the rules used if no rules file is specified: echo everything
+func DefaultRules() *Rules {
+	return &Rules{
+		Default:      &Rule{Type: RULE_ECHO},
+		Transactions: make(map[string]*Rule),
+	}
+}
+
+// LoadRules reads and validates a JSON rules file
+func LoadRules(fileName string) (*Rules, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %v", err)
+	}
+	rules := DefaultRules()
+	err = json.Unmarshal(data, rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %s: %v", fileName, err)
+	}
+	if rules.Default == nil {
+		rules.Default = &Rule{Type: RULE_ECHO}
+	}
+	err = rules.Default.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid default rule: %v", err)
+	}
+	// Transaction codes are matched in uppercase and without padding
+	normalized := make(map[string]*Rule, len(rules.Transactions))
+	for trancode, rule := range rules.Transactions {
+		err = rule.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule for %s: %v", trancode, err)
+		}
+		normalized[strings.ToUpper(strings.TrimSpace(trancode))] = rule
+	}
+	rules.Transactions = normalized
+	return rules, nil
+}
+
+// RuleFor returns the rule to be applied to a transaction code
+func (r *Rules) RuleFor(trancode string) *Rule {
+	rule, ok := r.Transactions[strings.ToUpper(strings.TrimSpace(trancode))]
+	if ok {
+		return rule
+	}
+	return r.Default
+}
+
+func (r *Rule) validate() error {
+	if r == nil {
+		return fmt.Errorf("empty rule")
+	}
+	if len(strings.TrimSpace(r.TPIPE)) > 8 {
+		return fmt.Errorf("TPIPE %s is longer than 8 characters", r.TPIPE)
+	}
+	switch r.Type {
+	case RULE_ECHO, RULE_STATIC:
+		return nil
+	case RULE_ERROR:
+		if r.Retcode == 0 {
+			return fmt.Errorf("error rules need a non-zero retcode")
+		}
+		if r.TPIPE != "" {
+			return fmt.Errorf("error rules have no output to queue to a TPIPE")
+		}
+		if r.Conversation {
+			return fmt.Errorf("error rules can not start a conversation")
+		}
+		return nil
+	case RULE_CALLOUT:
+		if strings.TrimSpace(r.TPIPE) == "" {
+			return fmt.Errorf("callout rules need the tpipe that gets the callout requests")
+		}
+		if r.Timeout < 0 {
+			return fmt.Errorf("the callout timeout can not be negative")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown rule type %q", r.Type)
+	}
+}
+
+// calloutTimeout returns the time a callout rule waits for the response
+func (r *Rule) calloutTimeout() time.Duration {
+	if r.Timeout == 0 {
+		return DEFAULT_CALLOUT_TIMEOUT
+	}
+	return time.Duration(r.Timeout)
+}
@@ -0,0 +1,439 @@
+// Package simulator implements a minimal IMS Connect server, used to test the injector
+// without an IMS system.
+//
+// The simulator accepts IRM messages built for the HWSSMPL0/HWSSMPL1 exits, in ASCII or
+// in EBCDIC, and answers the transactions using a set of scripted rules. The output of
+// the rules with a TPIPE is also queued to it, to be retrieved with RESUME TPIPE, and the
+// callout rules send synchronous callout requests to a TPIPE, as the ICAL calls do. The
+// conversational rules keep routing the messages of their connection to the transaction
+// until the client deallocates the conversation.
+package simulator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/codepage"
+	"github.com/jguillaumes/ims-injector/internal/irm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum message length accepted by the simulator
+const maxMessageLen = 1024 * 1024
+
+// Server is a simulated IMS Connect port
+type Server struct {
+	Rules     *Rules             // Rules used to answer the transactions
+	Codepage  *codepage.Codepage // Codepage used for EBCDIC requests
+	Nowait    bool               // Allow ACKs with the NOWAIT option
+	TLSConfig *tls.Config        // If not nil, the connections use TLS
+
+	listener   net.Listener
+	lock       sync.Mutex
+	clients    map[string]bool
+	nextClient int
+	queues     *holdQueues
+	callouts   map[string]*calloutCall // Synchronous callout requests waiting for a response, by correlation token
+	nextToken  int
+}
+
+// NewServer creates a simulator. If cp is nil, the IBM-037 codepage is used for EBCDIC requests.
+func NewServer(rules *Rules, cp *codepage.Codepage, tlsConfig *tls.Config) (*Server, error) {
+	if cp == nil {
+		var err error
+		cp, err = codepage.Lookup("037")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rules == nil {
+		rules = DefaultRules()
+	}
+	return &Server{
+		Rules:     rules,
+		Codepage:  cp,
+		Nowait:    true,
+		TLSConfig: tlsConfig,
+		clients:   make(map[string]bool),
+		queues:    newHoldQueues(),
+		callouts:  make(map[string]*calloutCall),
+	}, nil
+}
+
+// Listen opens the listening socket in the given address ("host:port" or ":port")
+func (s *Server) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+	if s.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.TLSConfig)
+	}
+	s.listener = listener
+	return nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until the server is closed. Each connection is served
+// by its own goroutine.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %v", err)
+		}
+		log.Debugf("Connection accepted from %s", conn.RemoteAddr())
+		c := &connection{server: s, conn: conn}
+		go c.run()
+	}
+}
+
+// Close stops accepting connections
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// registerClient reserves a client ID for a connection. An empty client ID is replaced
+// by a generated one. It returns false if the client ID is in use by another connection.
+func (s *Server) registerClient(clientId string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if clientId == "" {
+		s.nextClient++
+		clientId = fmt.Sprintf("HWS%05d", s.nextClient)
+	}
+	if s.clients[clientId] {
+		return clientId, false
+	}
+	s.clients[clientId] = true
+	return clientId, true
+}
+
+func (s *Server) releaseClient(clientId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, clientId)
+}
+
+// connection keeps the state of a client socket
+type connection struct {
+	server      *Server
+	conn        net.Conn
+	clientId    string
+	pendingAck  bool
+	pendingCM1  bool // The pending ACK commits a send-then-commit transaction
+	resumeState *resumeState
+	conv        *conversation // Conversation in progress, if any
+}
+
+// conversation is the state of a conversational transaction, kept between the messages
+// of its connection as IMS keeps the SPA
+type conversation struct {
+	trancode  string
+	rule      *Rule
+	iteration int
+}
+
+func (c *connection) run() {
+	defer func() {
+		c.endResume()
+		if c.clientId != "" {
+			c.server.releaseClient(c.clientId)
+		}
+		c.conn.Close()
+		log.Debugf("Connection from %s closed", c.conn.RemoteAddr())
+	}()
+
+	for {
+		data, err := readMessage(c.conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Warnf("Error reading from %s: %v", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		var cp *codepage.Codepage
+		if irm.IsEBCDIC(data) {
+			cp = c.server.Codepage
+		}
+
+		var resp *irm.Response
+		var disconnect bool
+		req, segments, err := irm.DeserializeMessage(data, cp)
+		if err != nil {
+			log.Warnf("Invalid message received from %s: %v", c.conn.RemoteAddr(), err)
+			resp, disconnect = rsmResponse(0x0008, 0x0006)
+		} else {
+			resp, disconnect = c.process(req, segments, cp)
+		}
+
+		if resp != nil {
+			buf := new(bytes.Buffer)
+			err = resp.Serialize(buf, cp)
+			if err != nil {
+				log.Errorf("Failed to build response: %v", err)
+				return
+			}
+			_, err = c.conn.Write(buf.Bytes())
+			if err != nil {
+				log.Warnf("Error writing to %s: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+		}
+		if disconnect {
+			return
+		}
+	}
+}
+
+// process handles a client message, returning the response to be sent (nil if none)
+// and if the socket must be disconnected afterwards
+func (c *connection) process(req *irm.IRM, segments []irm.Segment, cp *codepage.Codepage) (*irm.Response, bool) {
+	user := &req.Irm_user
+
+	switch user.Irm_f4 {
+	case irm.IRM_F4_SENDREC, irm.IRM_F4_SENDONLY, irm.IRM_F4_SNDONLYA, irm.IRM_F4_SNDONLYE:
+		if c.clientId == "" {
+			clientId, ok := c.server.registerClient(strings.TrimSpace(req.Irm_clientid))
+			if !ok {
+				log.Warnf("Duplicate client ID %s", clientId)
+				return rsmResponse(0x0008, 0x0038)
+			}
+			c.clientId = clientId
+		}
+		if user.Irm_f4 != irm.IRM_F4_SENDREC {
+			return c.sendOnly(req, segments, cp)
+		}
+		return c.transaction(req, segments, cp)
+
+	case irm.IRM_F4_RESUMET:
+		if c.clientId == "" {
+			clientId := strings.TrimSpace(req.Irm_clientid)
+			if clientId == "" {
+				log.Warnf("RESUME TPIPE without client ID")
+				return rsmResponse(0x0008, 0x0010)
+			}
+			if _, ok := c.server.registerClient(clientId); !ok {
+				log.Warnf("Duplicate client ID %s", clientId)
+				return rsmResponse(0x0008, 0x0038)
+			}
+			c.clientId = clientId
+		}
+		return c.resume(req, cp)
+
+	case irm.IRM_F4_ACK, irm.IRM_F4_NACK:
+		if !c.pendingAck {
+			log.Warnf("Client %s sent an unexpected ACK/NAK", c.clientId)
+			return rsmResponse(0x0008, 0x0024)
+		}
+		c.pendingAck = false
+		log.Debugf("Client %s sent %c", c.clientId, user.Irm_f4)
+		if user.Irm_f4 == irm.IRM_F4_NACK && req.Irm_f0&irm.IRM_F0_NAKRSN != 0 {
+			log.Infof("Client %s: NAK reason code %d", c.clientId, req.Irm_nak_rsncode)
+		}
+		if c.resumeState != nil && c.resumeState.pending != nil {
+			resp, disconnect, handled := c.resumeAck(req, cp)
+			if handled {
+				return resp, disconnect
+			}
+		} else if c.pendingCM1 {
+			// The ACK commits the transaction and the NAK backs it out
+			c.pendingCM1 = false
+			if user.Irm_f4 == irm.IRM_F4_ACK {
+				log.Infof("Client %s: transaction committed", c.clientId)
+			} else {
+				log.Infof("Client %s: transaction backed out", c.clientId)
+			}
+			return &irm.Response{CSM: &irm.CSM{}}, false
+		}
+		return c.noMoreOutput(req)
+
+	case irm.IRM_F4_SYNRESP, irm.IRM_F4_SYNRESPA:
+		return c.calloutResponse(req, segments, cp)
+
+	case irm.IRM_F4_DEALLOC:
+		if c.conv == nil {
+			log.Infof("Client %s: no conversation to deallocate", c.clientId)
+		} else {
+			log.Infof("Client %s: conversation %s deallocated after %d iterations", c.clientId, c.conv.trancode, c.conv.iteration)
+			c.conv = nil
+		}
+		return &irm.Response{CSM: &irm.CSM{}}, false
+
+	default:
+		log.Warnf("Unsupported message type %q from client %s", user.Irm_f4, c.clientId)
+		return rsmResponse(0x0008, 0x0024)
+	}
+}
+
+// noMoreOutput answers an ACK when there is no more output to send: the timer expires,
+// unless the ACK uses the NOWAIT option
+func (c *connection) noMoreOutput(req *irm.IRM) (*irm.Response, bool) {
+	if req.Irm_user.Irm_f1&irm.IRM_F1_NOWAIT != 0 || req.Irm_timer == irm.IRM_TIMER_NOWAIT {
+		return nil, false
+	}
+	time.Sleep(irm.TimerDuration(req.Irm_timer))
+	return rsmResponse(0x0028, uint32(req.Irm_timer))
+}
+
+// transaction answers a send-receive message using the rules
+func (c *connection) transaction(req *irm.IRM, segments []irm.Segment, cp *codepage.Codepage) (*irm.Response, bool) {
+	trancode := strings.TrimSpace(req.Irm_user.Irm_trncod)
+	if trancode == "" && len(segments) > 0 {
+		trancode = strings.SplitN(cp.Decode(segments[0].Data), " ", 2)[0]
+	}
+	cm1 := req.Irm_user.Irm_f2&irm.IRM_F2_CM1 != 0
+	if !cm1 && req.Irm_user.Irm_f3&irm.IRM_F3_SYNCPTX != 0 {
+		log.Warnf("Client %s: sync level Syncpt is only valid for CM1", c.clientId)
+		return rsmResponse(0x0008, 0x0024)
+	}
+	rule := c.server.Rules.RuleFor(trancode)
+	if c.conv != nil {
+		// The input continues the conversation, whatever its transaction code
+		c.conv.iteration++
+		trancode, rule = c.conv.trancode, c.conv.rule
+		log.Infof("Client %s: conversation %s, iteration %d", c.clientId, trancode, c.conv.iteration)
+	} else if rule.Conversation {
+		c.conv = &conversation{trancode: trancode, rule: rule, iteration: 1}
+		log.Infof("Client %s: conversation %s started", c.clientId, trancode)
+	}
+	log.Infof("Client %s: transaction %s, %d segments, rule %s", c.clientId, trancode, len(segments), rule.Type)
+
+	delay := time.Duration(rule.Delay)
+	timer := irm.TimerDuration(req.Irm_timer)
+	if timer > 0 && delay > timer {
+		time.Sleep(timer)
+		log.Infof("Client %s: transaction %s timed out", c.clientId, trancode)
+		return rsmResponse(0x0020, uint32(req.Irm_timer))
+	}
+	time.Sleep(delay)
+
+	resp := &irm.Response{}
+	switch rule.Type {
+	case RULE_ERROR:
+		return rsmResponse(uint32(rule.Retcode), uint32(rule.Reason))
+	case RULE_ECHO:
+		resp.Segments = segments
+	case RULE_CALLOUT:
+		wait := rule.calloutTimeout()
+		if timer > 0 && timer-delay < wait {
+			wait = timer - delay
+		}
+		output, ok := c.callout(rule, segments, wait, cp)
+		if !ok {
+			log.Infof("Client %s: transaction %s timed out", c.clientId, trancode)
+			return rsmResponse(0x0020, uint32(req.Irm_timer))
+		}
+		for _, text := range output {
+			data, err := cp.Encode(text)
+			if err != nil {
+				log.Errorf("Can not encode the response for %s: %v", trancode, err)
+				return rsmResponse(0x0008, 0x0009)
+			}
+			resp.Segments = append(resp.Segments, irm.Segment{Data: data})
+		}
+	case RULE_STATIC:
+		for _, text := range rule.Segments {
+			data, err := cp.Encode(text)
+			if err != nil {
+				log.Errorf("Can not encode the response for %s: %v", trancode, err)
+				return rsmResponse(0x0008, 0x0009)
+			}
+			resp.Segments = append(resp.Segments, irm.Segment{Data: data})
+		}
+	}
+
+	if req.Irm_user.Irm_f1&irm.IRM_F1_MFSREQ != 0 && rule.Modname != "" {
+		resp.MOD = &irm.MOD{Modname: rule.Modname}
+	}
+
+	c.queueOutput(rule, segments, cp)
+	resp.CSM = &irm.CSM{}
+	if req.Irm_user.Irm_f3&(irm.IRM_F3_SYNCCONF|irm.IRM_F3_SYNCPTX) == irm.IRM_F3_SYNCCONF {
+		resp.CSM.Flags |= irm.STS_F_ACKREQ
+		if c.server.Nowait && !cm1 {
+			resp.CSM.Flags |= irm.STS_F_NOWAIT
+		}
+		c.pendingAck = true
+		c.pendingCM1 = cm1
+	}
+	return resp, false
+}
+
+// sendOnly accepts a send-only message. The error rules reject it, returning their RSM
+// unless the message type has no response at all. The messages with ACK get a CSM.
+func (c *connection) sendOnly(req *irm.IRM, segments []irm.Segment, cp *codepage.Codepage) (*irm.Response, bool) {
+	user := &req.Irm_user
+	trancode := strings.TrimSpace(user.Irm_trncod)
+	if trancode == "" && len(segments) > 0 {
+		trancode = strings.SplitN(cp.Decode(segments[0].Data), " ", 2)[0]
+	}
+	rule := c.server.Rules.RuleFor(trancode)
+	ordered := user.Irm_f3&irm.IRM_F3_ORDER != 0
+	log.Infof("Client %s: send-only (%c) transaction %s, %d segments, ordered %t, rule %s", c.clientId, user.Irm_f4, trancode, len(segments), ordered, rule.Type)
+
+	if rule.Type == RULE_ERROR {
+		if user.Irm_f4 == irm.IRM_F4_SENDONLY {
+			log.Infof("Client %s: send-only transaction %s rejected", c.clientId, trancode)
+			return nil, false
+		}
+		return rsmResponse(uint32(rule.Retcode), uint32(rule.Reason))
+	}
+	c.queueOutput(rule, segments, cp)
+	if rule.Type == RULE_CALLOUT {
+		// Nobody waits for the output, but the ICAL still waits for its response
+		go c.callout(rule, segments, rule.calloutTimeout(), cp)
+	}
+	if user.Irm_f4 == irm.IRM_F4_SNDONLYA {
+		return &irm.Response{CSM: &irm.CSM{}}, false
+	}
+	return nil, false
+}
+
+// rsmResponse builds a response containing just an RSM. It also returns if the
+// return code implies the socket must be disconnected.
+func rsmResponse(retcode uint32, rsncode uint32) (*irm.Response, bool) {
+	resp := &irm.Response{
+		RSM: &irm.RSM{Retcode: retcode, Rsncode: rsncode},
+	}
+	return resp, resp.RSM.Disconnects()
+}
+
+// readMessage reads a complete client message, using the LLLL field
+func readMessage(conn net.Conn) ([]byte, error) {
+	llll_be := make([]byte, 4)
+	_, err := io.ReadFull(conn, llll_be)
+	if err != nil {
+		return nil, err
+	}
+	llll := binary.BigEndian.Uint32(llll_be)
+	if llll < 4 || llll > maxMessageLen {
+		return nil, fmt.Errorf("invalid message length %d", llll)
+	}
+	data := make([]byte, llll)
+	copy(data, llll_be)
+	_, err = io.ReadFull(conn, data[4:])
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,264 @@
+package simulator
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/codepage"
+	"github.com/jguillaumes/ims-injector/internal/irm"
+	log "github.com/sirupsen/logrus"
+)
+
+// holdQueues keeps the messages queued to each TPIPE, to be retrieved by RESUME TPIPE
+// requests: the asynchronous output and the synchronous callout requests. The messages
+// are kept as text, and they are encoded with the codepage of the client retrieving them.
+// It is safe for concurrent use.
+type holdQueues struct {
+	lock   sync.Mutex
+	queues map[string][]*heldMessage
+	added  chan struct{} // Closed and replaced each time a message is queued
+}
+
+// heldMessage is a message queued to a TPIPE
+type heldMessage struct {
+	segments []string
+	call     *calloutCall // Synchronous callout request waiting for its response (nil for asynchronous output)
+}
+
+func newHoldQueues() *holdQueues {
+	return &holdQueues{
+		queues: make(map[string][]*heldMessage),
+		added:  make(chan struct{}),
+	}
+}
+
+// put adds a message at the end of the queue of a TPIPE
+func (h *holdQueues) put(tpipe string, msg *heldMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.queues[tpipe] = append(h.queues[tpipe], msg)
+	close(h.added)
+	h.added = make(chan struct{})
+}
+
+// putBack returns a message not acknowledged to the front of the queue of a TPIPE
+func (h *holdQueues) putBack(tpipe string, msg *heldMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.queues[tpipe] = append([]*heldMessage{msg}, h.queues[tpipe]...)
+	close(h.added)
+	h.added = make(chan struct{})
+}
+
+// remove takes a message out of the queue of a TPIPE, if it is still there
+func (h *holdQueues) remove(tpipe string, msg *heldMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	queue := h.queues[tpipe]
+	for n, m := range queue {
+		if m == msg {
+			h.queues[tpipe] = append(queue[:n:n], queue[n+1:]...)
+			return
+		}
+	}
+}
+
+// get removes the first message of the queue of a TPIPE accepted by the filter, waiting
+// up to wait for one to arrive if there is none, or until stop is closed. It returns
+// nil if there is no message.
+func (h *holdQueues) get(tpipe string, filter func(*heldMessage) bool, wait time.Duration, stop <-chan struct{}) *heldMessage {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		h.lock.Lock()
+		queue := h.queues[tpipe]
+		for n, msg := range queue {
+			if filter(msg) {
+				h.queues[tpipe] = append(queue[:n:n], queue[n+1:]...)
+				h.lock.Unlock()
+				return msg
+			}
+		}
+		added := h.added
+		h.lock.Unlock()
+		select {
+		case <-added:
+		case <-timer.C:
+			return nil
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// Queue adds a message to the hold queue of a TPIPE, as if an IMS application had
+// inserted it to an alternate PCB
+func (s *Server) Queue(tpipe string, segments ...string) {
+	s.queues.put(strings.ToUpper(strings.TrimSpace(tpipe)), &heldMessage{segments: segments})
+}
+
+// resumeState keeps the RESUME TPIPE flow in progress on a connection
+type resumeState struct {
+	tpipe   string       // TPIPE being resumed
+	mode    uint8        // IRM_F5 flavor
+	sync    uint8        // IRM_F0 flags selecting the synchronous callout requests
+	pending *heldMessage // Message sent and waiting for its ACK or NAK (nil if none)
+}
+
+// wants checks if a queued message is retrieved by the RESUME TPIPE flow: the
+// synchronous callout requests are only sent if they are requested
+func (r *resumeState) wants(msg *heldMessage) bool {
+	switch {
+	case r.sync&irm.IRM_F0_SYNONLY != 0:
+		return msg.call != nil
+	case r.sync&irm.IRM_F0_SYNASIN != 0:
+		return true
+	default:
+		return msg.call == nil
+	}
+}
+
+// resume starts a RESUME TPIPE flow, sending the first message of the queue
+func (c *connection) resume(req *irm.IRM, cp *codepage.Codepage) (*irm.Response, bool) {
+	tpipe := strings.TrimSpace(req.Irm_user.Irm_rt_altcid)
+	if tpipe == "" {
+		tpipe = c.clientId
+	}
+	c.resumeState = &resumeState{
+		tpipe: strings.ToUpper(tpipe),
+		mode:  req.Irm_f5,
+		sync:  req.Irm_f0 & (irm.IRM_F0_SYNONLY | irm.IRM_F0_SYNASIN),
+	}
+	log.Infof("Client %s: RESUME TPIPE %s, options %02X, flags %02X", c.clientId, c.resumeState.tpipe, req.Irm_f5, req.Irm_f0)
+	return c.nextMessage(req.Irm_timer, cp)
+}
+
+// nextMessage sends the next message of the TPIPE being resumed. The single message with
+// wait and the auto flavors wait up to the IRM timer for a message to arrive, while the
+// others report the timer expiration at once if the queue is empty.
+func (c *connection) nextMessage(timer uint8, cp *codepage.Codepage) (*irm.Response, bool) {
+	state := c.resumeState
+	var wait time.Duration
+	if state.mode&(irm.IRM_F5_SNGLWT|irm.IRM_F5_AUTO) != 0 {
+		wait = irm.TimerDuration(timer)
+	}
+	msg, closed := c.waitMessage(state, wait)
+	if closed {
+		log.Infof("Client %s: connection closed while waiting for a message of TPIPE %s", c.clientId, state.tpipe)
+		c.resumeState = nil
+		return nil, true
+	}
+	if msg == nil {
+		log.Infof("Client %s: no messages in TPIPE %s", c.clientId, state.tpipe)
+		c.resumeState = nil
+		return rsmResponse(0x0028, uint32(timer))
+	}
+	resp := &irm.Response{CSM: &irm.CSM{Flags: irm.STS_F_ACKREQ}}
+	for _, text := range msg.segments {
+		data, err := cp.Encode(text)
+		if err != nil {
+			log.Errorf("Can not encode the message of TPIPE %s: %v", state.tpipe, err)
+			c.server.queues.putBack(state.tpipe, msg)
+			c.resumeState = nil
+			return rsmResponse(0x0008, 0x0009)
+		}
+		resp.Segments = append(resp.Segments, irm.Segment{Data: data})
+	}
+	if msg.call != nil {
+		resp.CT = &irm.CT{Token: msg.call.token}
+	}
+	state.pending = msg
+	c.pendingAck = true
+	return resp, false
+}
+
+// waitMessage gets the next message of the TPIPE being resumed, waiting up to wait for it.
+// While waiting, the connection is read to notice the client closing it, so the client ID
+// is released at once. The client must not send anything while it waits for the message,
+// so receiving data also ends the wait, and the connection, as if it had been closed.
+func (c *connection) waitMessage(state *resumeState, wait time.Duration) (msg *heldMessage, closed bool) {
+	if wait <= 0 {
+		return c.server.queues.get(state.tpipe, state.wants, 0, nil), false
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var b [1]byte
+		_, err := c.conn.Read(b[:])
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return // Interrupted after getting a message
+		}
+		closed = true
+		close(stop)
+	}()
+	msg = c.server.queues.get(state.tpipe, state.wants, wait, stop)
+	c.conn.SetReadDeadline(time.Now())
+	<-done
+	c.conn.SetReadDeadline(time.Time{})
+	if closed && msg != nil {
+		c.server.queues.putBack(state.tpipe, msg)
+		return nil, true
+	}
+	return msg, closed
+}
+
+// resumeAck handles the ACK or NAK of a message sent by a RESUME TPIPE flow, or the
+// callout response that acknowledges a synchronous callout request. The ACK removes the
+// message from the queue and, in the auto and noauto flavors, the next message is sent.
+// The NAK keeps an asynchronous message in the queue and ends the flow, while it returns
+// an error to the ICAL call of a callout request, which is not sent again. It returns
+// false if the rest of the flow is the same as for the output of a transaction.
+func (c *connection) resumeAck(req *irm.IRM, cp *codepage.Codepage) (*irm.Response, bool, bool) {
+	state := c.resumeState
+	msg := state.pending
+	state.pending = nil
+	switch {
+	case req.Irm_user.Irm_f4 != irm.IRM_F4_NACK:
+		log.Infof("Client %s: message of TPIPE %s delivered", c.clientId, state.tpipe)
+	case msg.call != nil:
+		log.Infof("Client %s: callout request of TPIPE %s rejected", c.clientId, state.tpipe)
+		c.server.answerCallout(msg.call.token, &calloutResult{nak: true, reason: req.Irm_nak_rsncode})
+	default:
+		log.Infof("Client %s: message kept in TPIPE %s", c.clientId, state.tpipe)
+		c.server.queues.putBack(state.tpipe, msg)
+		c.resumeState = nil
+		return nil, false, false
+	}
+	if state.mode&(irm.IRM_F5_AUTO|irm.IRM_F5_NOAUTO) == 0 {
+		c.resumeState = nil
+		return nil, false, false
+	}
+	resp, disconnect := c.nextMessage(req.Irm_timer, cp)
+	return resp, disconnect, true
+}
+
+// endResume returns the message waiting for its ACK, if any, to the queue when the
+// connection is closed
+func (c *connection) endResume() {
+	if c.resumeState != nil && c.resumeState.pending != nil {
+		log.Infof("Client %s: message not acknowledged, kept in TPIPE %s", c.clientId, c.resumeState.tpipe)
+		c.server.queues.putBack(c.resumeState.tpipe, c.resumeState.pending)
+	}
+	c.resumeState = nil
+}
+
+// queueOutput queues the output of a rule to its TPIPE, if it has one
+func (c *connection) queueOutput(rule *Rule, segments []irm.Segment, cp *codepage.Codepage) {
+	if rule.TPIPE == "" || rule.Type == RULE_CALLOUT {
+		return
+	}
+	output := rule.Segments
+	if rule.Type == RULE_ECHO {
+		output = make([]string, 0, len(segments))
+		for _, seg := range segments {
+			output = append(output, cp.Decode(seg.Data))
+		}
+	}
+	c.server.Queue(rule.TPIPE, output...)
+	log.Infof("Client %s: output queued to TPIPE %s", c.clientId, strings.ToUpper(rule.TPIPE))
+}
@@ -0,0 +1,208 @@
+// Package stats computes the latency and throughput statistics of an injector run.
+package stats
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm_net"
+)
+
+// Series is a set of latency samples
+type Series struct {
+	OK      int
+	KO      int
+	samples []time.Duration
+}
+
+// Summary contains the statistics of a Series
+type Summary struct {
+	Count  int
+	Min    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+	Stddev time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P95    time.Duration
+	P99    time.Duration
+}
+
+// Add stores a latency sample
+func (s *Series) Add(d time.Duration) {
+	s.samples = append(s.samples, d)
+}
+
+// Summary computes the statistics of the samples. The percentiles use the nearest-rank method.
+func (s *Series) Summary() Summary {
+	n := len(s.samples)
+	if n == 0 {
+		return Summary{}
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, s.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sum float64
+	for _, d := range sorted {
+		sum += float64(d)
+	}
+	mean := sum / float64(n)
+	var sqdiff float64
+	for _, d := range sorted {
+		sqdiff += (float64(d) - mean) * (float64(d) - mean)
+	}
+
+	percentile := func(p float64) time.Duration {
+		rank := int(math.Ceil(p / 100 * float64(n)))
+		return sorted[max(rank, 1)-1]
+	}
+
+	return Summary{
+		Count:  n,
+		Min:    sorted[0],
+		Max:    sorted[n-1],
+		Mean:   time.Duration(mean),
+		Stddev: time.Duration(math.Sqrt(sqdiff / float64(n))),
+		P50:    percentile(50),
+		P90:    percentile(90),
+		P95:    percentile(95),
+		P99:    percentile(99),
+	}
+}
+
+// Collector accumulates the results of the transactions. It is not safe for concurrent use.
+type Collector struct {
+	first     time.Time
+	last      time.Time
+	total     Series
+	trans     map[string]*Series
+	connect   Series
+	firstByte Series
+	ack       Series
+	sendOnly  Series // Send-only messages, accounted apart since they have no response
+}
+
+// NewCollector creates an empty Collector
+func NewCollector() *Collector {
+	return &Collector{
+		trans: make(map[string]*Series),
+	}
+}
+
+// Add accounts for a transaction result. The round trip time is used as the transaction
+// latency, and it is only recorded if a response was received. The send-only messages are
+// accounted apart, using the time to send them (or to receive their ACK) as their latency.
+func (c *Collector) Add(result *irm_net.Result) {
+	end := result.Start.Add(result.Timing.RoundTrip + result.Timing.Ack)
+	if c.first.IsZero() || result.Start.Before(c.first) {
+		c.first = result.Start
+	}
+	if end.After(c.last) {
+		c.last = end
+	}
+
+	if result.SendOnly {
+		c.sendOnly.Add(result.Timing.RoundTrip)
+		if result.OK() {
+			c.sendOnly.OK++
+		} else {
+			c.sendOnly.KO++
+		}
+		if result.Timing.Connect > 0 {
+			c.connect.Add(result.Timing.Connect)
+		}
+		return
+	}
+
+	tran, ok := c.trans[result.Trancode]
+	if !ok {
+		tran = &Series{}
+		c.trans[result.Trancode] = tran
+	}
+	if result.OK() {
+		c.total.OK++
+		tran.OK++
+	} else {
+		c.total.KO++
+		tran.KO++
+	}
+
+	if result.Timing.RoundTrip > 0 {
+		c.total.Add(result.Timing.RoundTrip)
+		tran.Add(result.Timing.RoundTrip)
+		c.firstByte.Add(result.Timing.FirstByte)
+	}
+	if result.Timing.Connect > 0 {
+		c.connect.Add(result.Timing.Connect)
+	}
+	if result.Timing.Ack > 0 {
+		c.ack.Add(result.Timing.Ack)
+	}
+}
+
+// Elapsed returns the time between the first transaction sent and the last response received
+func (c *Collector) Elapsed() time.Duration {
+	return c.last.Sub(c.first)
+}
+
+// Report writes the statistics table
+func (c *Collector) Report(w io.Writer) {
+	elapsed := c.Elapsed()
+	count := c.total.OK + c.total.KO
+	throughput := 0.0
+	if elapsed > 0 {
+		throughput = float64(count) / elapsed.Seconds()
+	}
+	sent := c.sendOnly.OK + c.sendOnly.KO
+	if count > 0 || sent == 0 {
+		fmt.Fprintf(w, "Transactions: %d (%d OK, %d KO) in %v, throughput %.2f tps\n", count, c.total.OK, c.total.KO, elapsed.Round(time.Millisecond), throughput)
+	}
+	if sent > 0 {
+		fmt.Fprintf(w, "Send-only messages: %d (%d OK, %d KO) in %v, without response\n", sent, c.sendOnly.OK, c.sendOnly.KO, elapsed.Round(time.Millisecond))
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Latency (ms)\tcount\tok\tko\tmin\tmax\tmean\tstddev\tp50\tp90\tp95\tp99\ttps\t")
+	writeRow(tw, "ALL", &c.total, elapsed)
+
+	trancodes := make([]string, 0, len(c.trans))
+	for trancode := range c.trans {
+		trancodes = append(trancodes, trancode)
+	}
+	sort.Strings(trancodes)
+	for _, trancode := range trancodes {
+		writeRow(tw, trancode, c.trans[trancode], elapsed)
+	}
+
+	writeRow(tw, "Send-only", &c.sendOnly, elapsed)
+	writeRow(tw, "First byte", &c.firstByte, 0)
+	writeRow(tw, "Connect", &c.connect, 0)
+	writeRow(tw, "ACK", &c.ack, 0)
+	tw.Flush()
+}
+
+// writeRow writes the statistics of a Series. The throughput is only shown if elapsed is not zero.
+func writeRow(w io.Writer, name string, s *Series, elapsed time.Duration) {
+	sum := s.Summary()
+	if sum.Count == 0 && s.OK+s.KO == 0 {
+		return
+	}
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.3f", float64(d.Microseconds())/1000)
+	}
+	tps := ""
+	if elapsed > 0 {
+		tps = fmt.Sprintf("%.2f", float64(s.OK+s.KO)/elapsed.Seconds())
+	}
+	okko := []any{"", ""}
+	if s.OK+s.KO > 0 {
+		okko = []any{s.OK, s.KO}
+	}
+	fmt.Fprintf(w, "%s\t%d\t%v\t%v\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", name, sum.Count, okko[0], okko[1],
+		ms(sum.Min), ms(sum.Max), ms(sum.Mean), ms(sum.Stddev), ms(sum.P50), ms(sum.P90), ms(sum.P95), ms(sum.P99), tps)
+}
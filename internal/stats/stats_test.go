@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeriesSummary(t *testing.T) {
+	// 1ms to 100ms, added out of order
+	var hundred []time.Duration
+	for i := 100; i >= 1; i-- {
+		hundred = append(hundred, time.Duration(i)*time.Millisecond)
+	}
+
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		want    Summary
+	}{
+		{
+			name: "empty",
+			want: Summary{},
+		},
+		{
+			name:    "single sample",
+			samples: []time.Duration{5 * time.Millisecond},
+			want: Summary{
+				Count: 1,
+				Min:   5 * time.Millisecond, Max: 5 * time.Millisecond, Mean: 5 * time.Millisecond,
+				P50: 5 * time.Millisecond, P90: 5 * time.Millisecond, P95: 5 * time.Millisecond, P99: 5 * time.Millisecond,
+			},
+		},
+		{
+			name:    "four samples",
+			samples: []time.Duration{40 * time.Millisecond, 10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond},
+			want: Summary{
+				Count: 4,
+				Min:   10 * time.Millisecond, Max: 40 * time.Millisecond, Mean: 25 * time.Millisecond,
+				Stddev: time.Duration(11180340), // sqrt(125) ms
+				P50:    20 * time.Millisecond, P90: 40 * time.Millisecond, P95: 40 * time.Millisecond, P99: 40 * time.Millisecond,
+			},
+		},
+		{
+			name:    "hundred samples",
+			samples: hundred,
+			want: Summary{
+				Count: 100,
+				Min:   time.Millisecond, Max: 100 * time.Millisecond, Mean: 50500 * time.Microsecond,
+				Stddev: time.Duration(28866070), // sqrt(833.25) ms
+				P50:    50 * time.Millisecond, P90: 90 * time.Millisecond, P95: 95 * time.Millisecond, P99: 99 * time.Millisecond,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s Series
+			for _, d := range tt.samples {
+				s.Add(d)
+			}
+			got := s.Summary()
+			// The standard deviation is compared with a microsecond tolerance
+			diff := got.Stddev - tt.want.Stddev
+			if diff < -time.Microsecond || diff > time.Microsecond {
+				t.Errorf("Stddev = %v, want %v", got.Stddev, tt.want.Stddev)
+			}
+			got.Stddev = tt.want.Stddev
+			if got != tt.want {
+				t.Errorf("Summary() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
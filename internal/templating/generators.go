@@ -0,0 +1,179 @@
+package templating
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Characters used by %RANDSTR%
+const randomChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// csvData keeps the contents of a CSV file and the next row to be used
+type csvData struct {
+	columns map[string]int
+	rows    [][]string
+	next    int
+}
+
+// generate computes the value of a built-in generator
+func (e *Expander) generate(name string, args string) (string, error) {
+	var params []string
+	if args != "" {
+		params = strings.Split(args, ",")
+		for i := range params {
+			params[i] = strings.TrimSpace(params[i])
+		}
+	}
+
+	switch name {
+	case "SEQ":
+		nums, err := integers(params, 0, 2)
+		if err != nil {
+			return "", err
+		}
+		start, step := int64(1), int64(1)
+		if len(nums) > 0 {
+			start = nums[0]
+		}
+		if len(nums) > 1 {
+			step = nums[1]
+		}
+		value, ok := e.counters[args]
+		if !ok {
+			value = start
+		}
+		e.counters[args] = value + step
+		return strconv.FormatInt(value, 10), nil
+
+	case "RAND":
+		nums, err := integers(params, 2, 2)
+		if err != nil {
+			return "", err
+		}
+		if nums[1] < nums[0] {
+			return "", fmt.Errorf("the maximum is lower than the minimum")
+		}
+		return strconv.FormatInt(nums[0]+e.rnd.Int64N(nums[1]-nums[0]+1), 10), nil
+
+	case "RANDSTR":
+		nums, err := integers(params, 1, 1)
+		if err != nil {
+			return "", err
+		}
+		if nums[0] < 0 {
+			return "", fmt.Errorf("invalid length %d", nums[0])
+		}
+		buf := make([]byte, nums[0])
+		for i := range buf {
+			buf[i] = randomChars[e.rnd.IntN(len(randomChars))]
+		}
+		return string(buf), nil
+
+	case "TIMESTAMP":
+		layout := defaultTimestamp
+		if args != "" {
+			layout = args
+		}
+		return time.Now().Format(layout), nil
+
+	case "UUID":
+		if args != "" {
+			return "", fmt.Errorf("no arguments expected")
+		}
+		var b [16]byte
+		for i := range b {
+			b[i] = byte(e.rnd.UintN(256))
+		}
+		b[6] = (b[6] & 0x0F) | 0x40 // Version 4
+		b[8] = (b[8] & 0x3F) | 0x80 // RFC 4122 variant
+		return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+
+	case "CSV":
+		if len(params) != 2 {
+			return "", fmt.Errorf("file name and column expected")
+		}
+		return e.csvValue(params[0], params[1])
+	}
+	return "", fmt.Errorf("unknown generator %s", name)
+}
+
+// csvValue returns the value of a column in the current row of a CSV file. The column
+// can be specified by its name in the header line or by its number (starting at 1).
+func (e *Expander) csvValue(fileName string, column string) (string, error) {
+	data, ok := e.csvFiles[fileName]
+	if !ok {
+		var err error
+		data, err = loadCSV(fileName)
+		if err != nil {
+			return "", err
+		}
+		e.csvFiles[fileName] = data
+	}
+
+	col, ok := data.columns[column]
+	if !ok {
+		n, err := strconv.Atoi(column)
+		if err != nil || n < 1 {
+			return "", fmt.Errorf("unknown column %s in %s", column, fileName)
+		}
+		col = n - 1
+	}
+
+	row, ok := e.rows[fileName]
+	if !ok {
+		row = data.next
+		data.next = (data.next + 1) % len(data.rows)
+		e.rows[fileName] = row
+	}
+	if col >= len(data.rows[row]) {
+		return "", fmt.Errorf("%s row %d has no column %s", fileName, row+2, column)
+	}
+	return data.rows[row][col], nil
+}
+
+// loadCSV reads a CSV file. The first line must contain the column names.
+func loadCSV(fileName string) (*csvData, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CSV file: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV file %s: %v", fileName, err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("CSV file %s has no data rows", fileName)
+	}
+	data := &csvData{
+		columns: make(map[string]int),
+		rows:    records[1:],
+	}
+	for i, name := range records[0] {
+		data.columns[strings.TrimSpace(name)] = i
+	}
+	return data, nil
+}
+
+// integers converts the generator arguments to integers, checking their number
+func integers(params []string, minArgs int, maxArgs int) ([]int64, error) {
+	if len(params) < minArgs || len(params) > maxArgs {
+		return nil, fmt.Errorf("%d to %d arguments expected", minArgs, maxArgs)
+	}
+	nums := make([]int64, len(params))
+	for i, p := range params {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", p)
+		}
+		nums[i] = n
+	}
+	return nums, nil
+}
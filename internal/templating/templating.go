@@ -0,0 +1,207 @@
+// Package templating expands the placeholders found in the transaction messages.
+//
+// A placeholder has the form %NAME%, %NAME(arguments)% or %NAME:width%, %NAME(arguments):width%.
+// NAME is either a variable defined by the user or one of the built-in generators:
+//
+//	%SEQ%, %SEQ(start)%, %SEQ(start,step)%  Sequence counter (each different argument list has its own counter)
+//	%RAND(min,max)%                         Random integer between min and max (both included)
+//	%RANDSTR(length)%                       Random string of uppercase letters and digits
+//	%TIMESTAMP%, %TIMESTAMP(layout)%        Current time, using a Go time layout (default: DB2 timestamp format)
+//	%UUID%                                  Random UUID (version 4)
+//	%CSV(file,column)%                      Value of a column from a CSV file with a header line. The rows are
+//	                                        used in sequence, cycling at the end of the file. All the references
+//	                                        to the same file in a message use the same row.
+//
+// The width specification pads or truncates the value to a fixed length:
+//
+//	:N   left justified, padded with blanks
+//	:>N  right justified, padded with blanks
+//	:0N  right justified, padded with zeros
+//
+// A %% sequence represents a single percent sign.
+package templating
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default layout for %TIMESTAMP%
+const defaultTimestamp = "2006-01-02-15.04.05.000000"
+
+// Placeholder syntax: name, optional arguments and optional width specification
+var placeholder_regex = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(?:\(([^)]*)\))?(?::([0>]?)([0-9]+))?$`)
+
+// Names of the built-in generators
+var builtins = map[string]bool{
+	"SEQ":       true,
+	"RAND":      true,
+	"RANDSTR":   true,
+	"TIMESTAMP": true,
+	"UUID":      true,
+	"CSV":       true,
+}
+
+// Expander expands the placeholders of the messages. It keeps the state of the
+// generators (counters, CSV rows) and is not safe for concurrent use.
+type Expander struct {
+	vars     map[string]string
+	counters map[string]int64
+	csvFiles map[string]*csvData
+	rnd      *rand.Rand
+	rows     map[string]int // CSV rows used by the message being expanded
+}
+
+// NewExpander creates an Expander with the given variables. If seed is not zero,
+// the random generators always produce the same sequence of values.
+func NewExpander(vars map[string]string, seed uint64) (*Expander, error) {
+	for name := range vars {
+		if builtins[name] {
+			return nil, fmt.Errorf("variable %s has the name of a built-in generator", name)
+		}
+	}
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	return &Expander{
+		vars:     vars,
+		counters: make(map[string]int64),
+		csvFiles: make(map[string]*csvData),
+		rnd:      rand.New(rand.NewPCG(seed, seed>>32)),
+	}, nil
+}
+
+// ParseVariable splits a NAME=value variable definition
+func ParseVariable(def string) (string, string, error) {
+	name, value, ok := strings.Cut(def, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid variable definition %q, NAME=value expected", def)
+	}
+	return name, value, nil
+}
+
+// LoadEnvFile reads the NAME=value variable definitions in a file into vars.
+// Blank lines and lines starting with # are ignored.
+func LoadEnvFile(fileName string, vars map[string]string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to open variables file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, err := ParseVariable(text)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", fileName, line, err)
+		}
+		vars[name] = value
+	}
+	return scanner.Err()
+}
+
+// Expand replaces the placeholders in the segments of a message
+func (e *Expander) Expand(segments []string) ([]string, error) {
+	e.rows = make(map[string]int)
+	expanded := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		s, err := e.expandString(segment)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, s)
+	}
+	return expanded, nil
+}
+
+// expandString replaces the placeholders in a single string
+func (e *Expander) expandString(s string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+	var builder strings.Builder
+	for {
+		start := strings.IndexByte(s, '%')
+		if start < 0 {
+			builder.WriteString(s)
+			return builder.String(), nil
+		}
+		end := strings.IndexByte(s[start+1:], '%')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder in %q", s)
+		}
+		end += start + 1
+		builder.WriteString(s[:start])
+		if end == start+1 {
+			builder.WriteByte('%') // %% is a literal percent sign
+		} else {
+			value, err := e.placeholder(s[start+1 : end])
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString(value)
+		}
+		s = s[end+1:]
+	}
+}
+
+// placeholder computes the value of a placeholder (without the percent signs)
+func (e *Expander) placeholder(p string) (string, error) {
+	parts := placeholder_regex.FindStringSubmatch(p)
+	if parts == nil {
+		return "", fmt.Errorf("invalid placeholder %%%s%%", p)
+	}
+	name, args, justify, width := parts[1], parts[2], parts[3], parts[4]
+
+	var value string
+	var err error
+	if builtins[name] {
+		value, err = e.generate(name, args)
+		if err != nil {
+			return "", fmt.Errorf("%%%s%%: %v", p, err)
+		}
+	} else {
+		var ok bool
+		value, ok = e.vars[name]
+		if !ok {
+			return "", fmt.Errorf("undefined variable %s", name)
+		}
+	}
+
+	if width == "" {
+		return value, nil
+	}
+	n, _ := strconv.Atoi(width)
+	return pad(value, n, justify), nil
+}
+
+// pad sets a value to a fixed width
+func pad(value string, width int, justify string) string {
+	if len(value) > width {
+		if justify == "" {
+			return value[:width]
+		}
+		return value[len(value)-width:]
+	}
+	switch justify {
+	case "0":
+		return strings.Repeat("0", width-len(value)) + value
+	case ">":
+		return strings.Repeat(" ", width-len(value)) + value
+	default:
+		return value + strings.Repeat(" ", width-len(value))
+	}
+}
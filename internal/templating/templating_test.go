@@ -0,0 +1,186 @@
+package templating
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPad(t *testing.T) {
+	tests := []struct {
+		value   string
+		width   int
+		justify string
+		want    string
+	}{
+		{"ABC", 6, "", "ABC   "},
+		{"ABC", 6, ">", "   ABC"},
+		{"42", 6, "0", "000042"},
+		{"ABC", 3, "", "ABC"},
+		{"ABCDEF", 3, "", "ABC"},
+		{"ABCDEF", 3, ">", "DEF"},
+		{"123456", 4, "0", "3456"},
+		{"", 2, "", "  "},
+	}
+	for _, tt := range tests {
+		got := pad(tt.value, tt.width, tt.justify)
+		if got != tt.want {
+			t.Errorf("pad(%q, %d, %q) = %q, want %q", tt.value, tt.width, tt.justify, got, tt.want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages [][]string // Messages expanded one after another by the same Expander
+		want     [][]string
+	}{
+		{
+			name:     "no placeholders",
+			messages: [][]string{{"IVTNO DISPLAY LAST1"}},
+			want:     [][]string{{"IVTNO DISPLAY LAST1"}},
+		},
+		{
+			name:     "percent sign",
+			messages: [][]string{{"RATE 10%% OFF"}},
+			want:     [][]string{{"RATE 10% OFF"}},
+		},
+		{
+			name:     "variables with width",
+			messages: [][]string{{"IVTNO %CMD:8%%NAME:>10%", "%NAME%"}},
+			want:     [][]string{{"IVTNO DISPLAY      LAST1", "LAST1"}},
+		},
+		{
+			name:     "sequences",
+			messages: [][]string{{"%SEQ% %SEQ(100,10):05%"}, {"%SEQ% %SEQ(100,10):05%"}, {"%SEQ% %SEQ(100,10):05%"}},
+			want:     [][]string{{"1 00100"}, {"2 00110"}, {"3 00120"}},
+		},
+		{
+			name:     "sequence shared by the segments",
+			messages: [][]string{{"%SEQ(5)%", "%SEQ(5)%"}, {"%SEQ(5)%"}},
+			want:     [][]string{{"5", "6"}, {"7"}},
+		},
+	}
+	vars := map[string]string{"CMD": "DISPLAY", "NAME": "LAST1"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewExpander(vars, 1)
+			if err != nil {
+				t.Fatalf("NewExpander: %v", err)
+			}
+			for i, message := range tt.messages {
+				got, err := e.Expand(message)
+				if err != nil {
+					t.Fatalf("Expand(%q): %v", message, err)
+				}
+				if !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("Expand(%q) = %q, want %q", message, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	tests := []string{
+		"%UNDEFINED%",
+		"%SEQ",
+		"%SEQ(a)%",
+		"%SEQ(1,2,3)%",
+		"%RAND(9,1)%",
+		"%RAND(1)%",
+		"%RANDSTR(-1)%",
+		"%UUID(1)%",
+		"%CSV(file.csv)%",
+		"%BAD NAME%",
+	}
+	for _, message := range tests {
+		e, err := NewExpander(nil, 1)
+		if err != nil {
+			t.Fatalf("NewExpander: %v", err)
+		}
+		_, err = e.Expand([]string{message})
+		if err == nil {
+			t.Errorf("Expand(%q) did not fail", message)
+		}
+	}
+}
+
+func TestNewExpanderBuiltinName(t *testing.T) {
+	_, err := NewExpander(map[string]string{"SEQ": "1"}, 0)
+	if err == nil {
+		t.Error("NewExpander accepted a variable named as a generator")
+	}
+}
+
+func TestRandomGenerators(t *testing.T) {
+	message := []string{"%RAND(10,20)% %RANDSTR(12)% %UUID%"}
+	format := regexp.MustCompile(`^(\d+) ([A-Z0-9]{12}) [0-9A-F]{8}-[0-9A-F]{4}-4[0-9A-F]{3}-[89AB][0-9A-F]{3}-[0-9A-F]{12}$`)
+
+	first, err := NewExpander(nil, 42)
+	if err != nil {
+		t.Fatalf("NewExpander: %v", err)
+	}
+	second, err := NewExpander(nil, 42)
+	if err != nil {
+		t.Fatalf("NewExpander: %v", err)
+	}
+	for range 100 {
+		got, err := first.Expand(message)
+		if err != nil {
+			t.Fatalf("Expand: %v", err)
+		}
+		parts := format.FindStringSubmatch(got[0])
+		if parts == nil {
+			t.Fatalf("Expand = %q, invalid format", got[0])
+		}
+		n, _ := strconv.Atoi(parts[1])
+		if n < 10 || n > 20 {
+			t.Errorf("%%RAND(10,20)%% = %d, out of range", n)
+		}
+
+		// The same seed gives the same values
+		again, err := second.Expand(message)
+		if err != nil {
+			t.Fatalf("Expand: %v", err)
+		}
+		if again[0] != got[0] {
+			t.Errorf("Expand with the same seed = %q, want %q", again[0], got[0])
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "customers.csv")
+	err := os.WriteFile(fileName, []byte("ACCOUNT,NAME\n1001,SMITH\n1002,JONES\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewExpander(nil, 1)
+	if err != nil {
+		t.Fatalf("NewExpander: %v", err)
+	}
+
+	// The references of a message use the same row, and the rows cycle
+	message := []string{"%CSV(" + fileName + ",ACCOUNT):6%", "%CSV(" + fileName + ",2)%"}
+	want := []string{"1001  SMITH", "1002  JONES", "1001  SMITH"}
+	for _, w := range want {
+		got, err := e.Expand(message)
+		if err != nil {
+			t.Fatalf("Expand: %v", err)
+		}
+		if strings.Join(got, "") != w {
+			t.Errorf("Expand = %q, want %q", strings.Join(got, ""), w)
+		}
+	}
+
+	_, err = e.Expand([]string{"%CSV(" + fileName + ",PHONE)%"})
+	if err == nil {
+		t.Error("Expand accepted an unknown CSV column")
+	}
+}
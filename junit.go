@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jguillaumes/ims-injector/imsconnect"
+	"github.com/jguillaumes/ims-injector/internal/irm_net"
+)
+
+// Types of the JUnit failures
+const (
+	JUNIT_RSM         = "RSM"         // Request status message returned by IMS Connect
+	JUNIT_EXPECTATION = "expectation" // Response not meeting the expectation of the transaction
+	JUNIT_ERROR       = "error"       // Connection error, timeout or interruption
+)
+
+// junitReport accumulates the results of a run to write them as a JUnit XML report,
+// with a test case for each transaction. The transactions answered with an RSM or not
+// meeting their expectation are failures, and the ones without an answer are errors.
+// It is not safe for concurrent use.
+type junitReport struct {
+	suite junitSuite
+}
+
+// junitSuites is the root element of a JUnit XML report
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Hostname   string          `xml:"hostname,attr,omitempty"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitCase     `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	SystemOut *junitText    `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",cdata"`
+}
+
+// junitText is written as CDATA, to keep the line breaks of the segments readable
+type junitText struct {
+	Text string `xml:",cdata"`
+}
+
+// newJunitReport creates a report for a run. The name is used for the test suite, and
+// the properties describe the run.
+func newJunitReport(name string, start time.Time, properties ...junitProperty) *junitReport {
+	r := &junitReport{suite: junitSuite{
+		Name:       name,
+		Timestamp:  start.Format("2006-01-02T15:04:05"),
+		Properties: properties,
+	}}
+	if hostname, err := os.Hostname(); err == nil {
+		r.suite.Hostname = hostname
+	}
+	return r
+}
+
+// Add adds the test case of a transaction or of a conversation step
+func (r *junitReport) Add(result *irm_net.Result) {
+	tran := &result.Transaction
+	name := fmt.Sprintf("line %d", tran.Line)
+	if tran.Step > 0 {
+		name = fmt.Sprintf("line %d step %d", tran.Line, tran.Step)
+	}
+	if tran.Iteration > 1 {
+		name = fmt.Sprintf("%s (iteration %d)", name, tran.Iteration)
+	}
+	tc := junitCase{
+		Classname: result.Trancode,
+		Name:      name + ": " + firstLine(tran.Text),
+		Time:      seconds(result.Timing.RoundTrip),
+	}
+	if len(result.Segments) > 0 {
+		tc.SystemOut = &junitText{Text: xmlText(strings.Join(result.Segments, "\n"))}
+	}
+
+	var rsmErr *imsconnect.RSMError
+	switch {
+	case errors.As(result.Err, &rsmErr):
+		tc.Failure = &junitFailure{
+			Message: fmt.Sprintf("RC=%04X RSN=%04X: %s", rsmErr.RSM.Retcode, rsmErr.RSM.Rsncode, rsmErr.Message),
+			Type:    JUNIT_RSM,
+			Text:    rsmErr.Error(),
+		}
+	case !result.OK():
+		message := "empty response"
+		if result.Err != nil {
+			message = result.Err.Error()
+		}
+		tc.Error = &junitFailure{Message: message, Type: JUNIT_ERROR, Text: xmlText(message)}
+	case len(result.Failures) > 0:
+		tc.Failure = &junitFailure{
+			Message: firstLine(result.Failures[0]),
+			Type:    JUNIT_EXPECTATION,
+			Text:    xmlText(strings.Join(result.Failures, "\n")),
+		}
+	}
+	r.add(tc)
+}
+
+// AddWorkerError adds an error test case for a worker that ended with an error, like a
+// failed connection, so the report is not empty when IMS Connect can not be reached
+func (r *junitReport) AddWorkerError(err error) {
+	r.add(junitCase{
+		Classname: "worker",
+		Name:      "interaction with IMS Connect",
+		Time:      seconds(0),
+		Error:     &junitFailure{Message: err.Error(), Type: JUNIT_ERROR, Text: xmlText(err.Error())},
+	})
+}
+
+// add adds a test case, updating the counters of the test suite
+func (r *junitReport) add(tc junitCase) {
+	r.suite.Tests++
+	if tc.Failure != nil {
+		r.suite.Failures++
+	}
+	if tc.Error != nil {
+		r.suite.Errors++
+	}
+	r.suite.Cases = append(r.suite.Cases, tc)
+}
+
+// Write writes the report, given the elapsed time of the run
+func (r *junitReport) Write(w io.Writer, elapsed time.Duration) error {
+	r.suite.Time = seconds(elapsed)
+	suites := junitSuites{
+		Name:     r.suite.Name,
+		Tests:    r.suite.Tests,
+		Failures: r.suite.Failures,
+		Errors:   r.suite.Errors,
+		Time:     r.suite.Time,
+		Suites:   []junitSuite{r.suite},
+	}
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(suites)
+	if err == nil {
+		_, err = io.WriteString(w, "\n")
+	}
+	return err
+}
+
+// writeFile writes the report to a file
+func (r *junitReport) writeFile(fileName string, elapsed time.Duration) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	err = r.Write(file, elapsed)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// seconds formats a duration in seconds, with millisecond precision
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// xmlText replaces the characters not allowed in XML documents, like the control
+// characters of binary response fields, with the Unicode replacement character
+func xmlText(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return r
+		case r < 0x20, r >= 0xD800 && r <= 0xDFFF, r == 0xFFFE, r == 0xFFFF:
+			return utf8.RuneError
+		}
+		return r
+	}, s)
+}
+
+// firstLine returns the first line of a text
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm_net"
+	log "github.com/sirupsen/logrus"
+)
+
+// Minimum time between two "can't keep up" warnings
+const pacerWarnInterval = 5 * time.Second
+
+// cyclingReader reads the input file several times. It rewinds the file and creates a new
+// reader for it each time the end of the file is reached, until the number of iterations
+// is completed. If iterations is zero, the file is read again and again.
+type cyclingReader struct {
+	file       io.ReadSeeker
+	open       func(io.Reader) (transactionReader, error)
+	reader     transactionReader
+	iteration  int
+	iterations int
+	count      int // Transactions read in the current iteration
+}
+
+// newCyclingReader creates a cyclingReader, using open to build the reader for each iteration
+func newCyclingReader(file io.ReadSeeker, iterations int, open func(io.Reader) (transactionReader, error)) (*cyclingReader, error) {
+	reader, err := open(file)
+	if err != nil {
+		return nil, err
+	}
+	return &cyclingReader{
+		file:       file,
+		open:       open,
+		reader:     reader,
+		iteration:  1,
+		iterations: iterations,
+	}, nil
+}
+
+func (c *cyclingReader) Next() (irm_net.Transaction, error) {
+	for {
+		tran, err := c.reader.Next()
+		if err != io.EOF {
+			c.count++
+			tran.Iteration = c.iteration
+			for i := range tran.Steps {
+				tran.Steps[i].Iteration = c.iteration
+			}
+			return tran, err
+		}
+		if (c.iterations > 0 && c.iteration >= c.iterations) || c.count == 0 {
+			return tran, io.EOF
+		}
+		_, err = c.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return tran, err
+		}
+		c.reader, err = c.open(c.file)
+		if err != nil {
+			return tran, err
+		}
+		c.iteration++
+		c.count = 0
+		log.Debugf("Starting iteration %d of the input file", c.iteration)
+	}
+}
+
+// pacer schedules the transactions at a fixed rate (open model): the transaction n is
+// due at start + n/rate, regardless of the response times. If the workers can not take
+// the transactions when they are due, the transactions are sent as soon as possible
+// and a warning is issued.
+type pacer struct {
+	interval time.Duration
+	next     time.Time
+	delayed  int
+	maxLag   time.Duration
+	lastWarn time.Time
+}
+
+// newPacer creates a pacer for a rate in transactions per second. A zero rate means no pacing,
+// and returns a nil pacer.
+func newPacer(rate float64) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacer{
+		interval: time.Duration(float64(time.Second) / rate),
+	}
+}
+
+// wait blocks until the next transaction is due
+func (p *pacer) wait() {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	if p.next.IsZero() {
+		p.next = now
+	}
+	if p.next.After(now) {
+		time.Sleep(p.next.Sub(now))
+	}
+}
+
+// sent accounts for a transaction taken by a worker, checking if it was taken late
+func (p *pacer) sent() {
+	if p == nil {
+		return
+	}
+	lag := time.Since(p.next)
+	if lag > p.interval && lag > time.Millisecond {
+		p.delayed++
+		p.maxLag = max(p.maxLag, lag)
+		if time.Since(p.lastWarn) > pacerWarnInterval {
+			log.Warnf("The workers can't keep up with the target rate: %d transactions delayed so far (lag %v). Consider increasing -k", p.delayed, lag.Round(time.Millisecond))
+			p.lastWarn = time.Now()
+		}
+	}
+	p.next = p.next.Add(p.interval)
+}
+
+// report logs the number of delayed transactions, if any
+func (p *pacer) report() {
+	if p == nil || p.delayed == 0 {
+		return
+	}
+	log.Warnf("%d transactions could not be sent at the target rate (maximum lag %v)", p.delayed, p.maxLag.Round(time.Millisecond))
+}
+
+// A stage is a period of the run with a given number of workers. If ramp is true, the number
+// of workers changes linearly from the one of the previous stage to the one of this stage.
+type stage struct {
+	name     string
+	workers  int
+	duration time.Duration
+	ramp     bool
+}
+
+func (s stage) String() string {
+	if s.ramp {
+		return fmt.Sprintf("ramp to %d workers in %v", s.workers, s.duration)
+	}
+	return fmt.Sprintf("%d workers for %v", s.workers, s.duration)
+}
+
+// A profile is the list of stages of a run
+type profile []stage
+
+// parseStages parses a list of steps like "5:2m,20:5m,50:5m" (5 workers for 2 minutes,
+// then 20 workers for 5 minutes and then 50 workers for 5 minutes)
+func parseStages(spec string) (profile, error) {
+	var prof profile
+	for n, step := range strings.Split(spec, ",") {
+		workers, length, ok := strings.Cut(strings.TrimSpace(step), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid stage %q, workers:duration expected", step)
+		}
+		w, err := strconv.Atoi(workers)
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("invalid number of workers in stage %q", step)
+		}
+		d, err := time.ParseDuration(length)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration in stage %q", step)
+		}
+		prof = append(prof, stage{name: fmt.Sprintf("Stage %d", n+1), workers: w, duration: d})
+	}
+	return prof, nil
+}
+
+// rampProfile builds a profile from a "up,hold,down" specification like "1m,5m,30s": the
+// number of workers grows from 1 to workers during the up period, stays there during the
+// hold period and decreases to zero during the down period.
+func rampProfile(spec string, workers int) (profile, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid ramp %q, up,hold,down durations expected", spec)
+	}
+	durations := make([]time.Duration, 3)
+	for i, part := range parts {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid duration %q in ramp", part)
+		}
+		durations[i] = d
+	}
+	return profile{
+		{name: "Ramp up", workers: workers, duration: durations[0], ramp: true},
+		{name: "Hold", workers: workers, duration: durations[1]},
+		{name: "Ramp down", workers: 0, duration: durations[2], ramp: true},
+	}, nil
+}
+
+// duration returns the total duration of the profile
+func (p profile) duration() time.Duration {
+	var total time.Duration
+	for _, s := range p {
+		total += s.duration
+	}
+	return total
+}
+
+// maxWorkers returns the maximum number of workers used by the profile
+func (p profile) maxWorkers() int {
+	n := 0
+	for _, s := range p {
+		n = max(n, s.workers)
+	}
+	return n
+}
+
+// stageAt returns the index of the stage active at an offset from the start of the run
+func (p profile) stageAt(offset time.Duration) int {
+	for i, s := range p {
+		if offset < s.duration {
+			return i
+		}
+		offset -= s.duration
+	}
+	return len(p) - 1
+}
+
+// worker is an interaction goroutine managed by a workerPool
+type worker struct {
+	stop    chan struct{} // Closed to make the worker end after its current transaction
+	stopped bool
+	done    chan struct{} // Closed when the worker has ended
+}
+
+// workerPool starts and stops the interaction goroutines. The workers are numbered
+// using the lowest free numbers, so the client IDs are reused. A number is not
+// reused until the worker that had it has ended, and the numbers are kept below
+// the pool limit, so the client IDs built with them have a bounded length.
+type workerPool struct {
+	ctx     context.Context
+	run     func(ctx context.Context, stop <-chan struct{}, num int)
+	limit   int
+	workers map[int]*worker
+	target  int           // Number of running workers requested by the last resize
+	missing int           // Workers not started yet because their numbers are still in use
+	ended   chan struct{} // Signalled when a worker ends
+	wg      sync.WaitGroup
+}
+
+// newWorkerPool creates a pool of up to limit workers, which execute run. Cancelling ctx
+// aborts all the workers, including their transactions in progress.
+func newWorkerPool(ctx context.Context, limit int, run func(ctx context.Context, stop <-chan struct{}, num int)) *workerPool {
+	return &workerPool{
+		ctx:     ctx,
+		run:     run,
+		limit:   limit,
+		workers: make(map[int]*worker),
+		ended:   make(chan struct{}, 1),
+	}
+}
+
+// resize starts or stops workers to have n of them running, up to the pool limit. The
+// workers ended by themselves are replaced. The stopped workers end after their current
+// transaction: if all the free numbers are taken by them, the missing workers are started
+// by sleepUntil as soon as they end, so resize never blocks.
+func (p *workerPool) resize(n int) {
+	n = min(n, p.limit)
+	p.target = n
+	running := 0
+	for num, w := range p.workers {
+		select {
+		case <-w.done:
+			delete(p.workers, num)
+			continue
+		default:
+		}
+		if !w.stopped {
+			running++
+		}
+	}
+	for num := 0; running < n && num < p.limit; num++ {
+		if _, ok := p.workers[num]; ok {
+			continue
+		}
+		w := &worker{stop: make(chan struct{}), done: make(chan struct{})}
+		p.workers[num] = w
+		running++
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() {
+				close(w.done)
+				select {
+				case p.ended <- struct{}{}:
+				default: // Already signalled
+				}
+			}()
+			p.run(p.ctx, w.stop, num)
+		}()
+	}
+	p.missing = max(n-running, 0)
+	// Stop the workers with the highest numbers
+	nums := make([]int, 0, len(p.workers))
+	for num := range p.workers {
+		nums = append(nums, num)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(nums)))
+	for _, num := range nums {
+		if running <= n {
+			break
+		}
+		w := p.workers[num]
+		if w.stopped {
+			continue
+		}
+		close(w.stop)
+		w.stopped = true
+		running--
+	}
+	if p.missing > 0 {
+		log.Debugf("Running %d workers, %d waiting for the stopped ones to end", running, p.missing)
+	} else {
+		log.Debugf("Running %d workers", running)
+	}
+}
+
+// sleepUntil waits until a given time, starting the missing workers when the stopped
+// ones end. It returns false if the wait was interrupted because the done channel
+// was closed.
+func (p *workerPool) sleepUntil(t time.Time, done chan struct{}) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-done:
+			return false
+		case <-p.ended:
+			if p.missing > 0 {
+				p.resize(p.target)
+			}
+		}
+	}
+}
+
+// wait blocks until all the workers have ended
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// runProfile starts and stops the workers following the profile stages, from the start time
+// of the run. It returns when the profile is completed, or earlier if the input is exhausted
+// (inputDone is closed). In both cases it waits for the workers to end.
+func runProfile(pool *workerPool, prof profile, start time.Time, inputDone chan struct{}) {
+	defer pool.wait()
+	defer pool.resize(0)
+
+	// The stage boundaries are computed from the start of the run, so they match the
+	// ones used to account for the results of each stage
+	current := 0
+	stageEnd := start
+	for _, s := range prof {
+		log.Infof("%s: %s", s.name, s)
+		stageStart := stageEnd
+		stageEnd = stageStart.Add(s.duration)
+		if s.ramp && s.workers != current {
+			// Spread the worker changes over the stage
+			from := max(current, 1)
+			if current == 0 && s.workers > 0 {
+				pool.resize(1)
+			}
+			steps := s.workers - from
+			if steps < 0 {
+				steps = -steps
+			}
+			for i := 1; i <= steps; i++ {
+				at := stageStart.Add(s.duration * time.Duration(i) / time.Duration(steps))
+				if !pool.sleepUntil(at, inputDone) {
+					return
+				}
+				if s.workers > from {
+					pool.resize(from + i)
+				} else {
+					pool.resize(from - i)
+				}
+			}
+		} else {
+			pool.resize(s.workers)
+		}
+		current = s.workers
+		if !pool.sleepUntil(stageEnd, inputDone) {
+			return
+		}
+	}
+}
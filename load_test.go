@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStages(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    profile
+		wantErr bool
+	}{
+		{spec: "5:2m", want: profile{{name: "Stage 1", workers: 5, duration: 2 * time.Minute}}},
+		{spec: "5:2m, 20:5m,50:500ms", want: profile{
+			{name: "Stage 1", workers: 5, duration: 2 * time.Minute},
+			{name: "Stage 2", workers: 20, duration: 5 * time.Minute},
+			{name: "Stage 3", workers: 50, duration: 500 * time.Millisecond},
+		}},
+		{spec: "", wantErr: true},
+		{spec: "5", wantErr: true},
+		{spec: "0:1m", wantErr: true},
+		{spec: "x:1m", wantErr: true},
+		{spec: "5:0s", wantErr: true},
+		{spec: "5:-1m", wantErr: true},
+		{spec: "5:1m,", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStages(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseStages(%q) did not fail", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseStages(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseStages(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestRampProfile(t *testing.T) {
+	tests := []struct {
+		spec    string
+		workers int
+		want    profile
+		wantErr bool
+	}{
+		{spec: "1m,5m,30s", workers: 10, want: profile{
+			{name: "Ramp up", workers: 10, duration: time.Minute, ramp: true},
+			{name: "Hold", workers: 10, duration: 5 * time.Minute},
+			{name: "Ramp down", workers: 0, duration: 30 * time.Second, ramp: true},
+		}},
+		{spec: "0s, 1m, 0s", workers: 3, want: profile{
+			{name: "Ramp up", workers: 3, duration: 0, ramp: true},
+			{name: "Hold", workers: 3, duration: time.Minute},
+			{name: "Ramp down", workers: 0, duration: 0, ramp: true},
+		}},
+		{spec: "1m,5m", workers: 10, wantErr: true},
+		{spec: "1m,5m,30s,1m", workers: 10, wantErr: true},
+		{spec: "1m,x,30s", workers: 10, wantErr: true},
+		{spec: "1m,-5m,30s", workers: 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := rampProfile(tt.spec, tt.workers)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("rampProfile(%q) did not fail", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("rampProfile(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rampProfile(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestProfileStageAt(t *testing.T) {
+	prof, err := parseStages("1:1m,2:2m,3:30s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := prof.duration(); got != 3*time.Minute+30*time.Second {
+		t.Errorf("duration() = %v, want 3m30s", got)
+	}
+	if got := prof.maxWorkers(); got != 3 {
+		t.Errorf("maxWorkers() = %d, want 3", got)
+	}
+
+	tests := []struct {
+		offset time.Duration
+		want   int
+	}{
+		{0, 0},
+		{59 * time.Second, 0},
+		{time.Minute, 1},
+		{3*time.Minute - time.Nanosecond, 1},
+		{3 * time.Minute, 2},
+		{time.Hour, 2},
+	}
+	for _, tt := range tests {
+		got := prof.stageAt(tt.offset)
+		if got != tt.want {
+			t.Errorf("stageAt(%v) = %d, want %d", tt.offset, got, tt.want)
+		}
+	}
+}
@@ -2,14 +2,24 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/jguillaumes/ims-injector/internal/irm"
+	"github.com/jguillaumes/ims-injector/imsconnect"
 	"github.com/jguillaumes/ims-injector/internal/irm_net"
+	"github.com/jguillaumes/ims-injector/internal/stats"
+	"github.com/jguillaumes/ims-injector/internal/templating"
 	"github.com/schollz/progressbar/v3"
 	log "github.com/sirupsen/logrus"
 )
@@ -22,6 +32,10 @@ The messages are read from a file, and the responses are saved in an output file
 Usage:
 
 	ims-injector [options] <input file> <output file>
+	ims-injector serve [serve options]
+	ims-injector compare [compare options] <old results> <new results>
+	ims-injector resume [resume options] <output file>
+	ims-injector callout [callout options] <output file>
 
 The options are:
 
@@ -34,19 +48,83 @@ The options are:
 	-c <clientid>  The client ID to use for the connection (Default: generated by the IMS system)
 	-t <lterm>	   The logical terminal name to use for the connection (Default: "INJECTOR")
 	-k <concurrent> The number of concurrent transactions to send (Default: 1)
+	-e <ccsid>     Convert the messages to and from the given EBCDIC CCSID (Default: no conversion)
+	-f <format>    Output file format: text or jsonl (Default: text)
+	-if <format>   Input file format: text or jsonl (Default: text)
+	-s <separator> Segment separator for multi-segment messages in text input files (Default: none)
+	-T             Expand the %...% placeholders of the messages (Default: false)
+	-D <NAME=val>  Define a variable for the placeholders. Can be repeated. Implies -T
+	-env <file>    Read the variables for the placeholders from a file with NAME=value lines. Implies -T
+	-seed <n>      Seed for the random placeholders, to repeat the same values (Default: 0, random)
+	-rate <tps>    Send the transactions at a fixed rate, in transactions per second (Default: 0, as fast as possible)
+	-duration <d>  Run for a fixed time (like 90s or 10m), reading the input file again when its end is reached
+	-n <count>     Number of times the input file is read (Default: 1, or unlimited if -duration is specified)
+	-ramp <u,h,d>  Ramp the workers up from 1 to <concurrent> in u, hold them for h and ramp them down in d (like 1m,5m,30s)
+	-stages <list> Run a list of stages of workers:duration (like 5:2m,20:5m,50:5m). The -k option is ignored
+	-junit <file>  Write a JUnit XML report, with a test case for each transaction
+	-checkpoint <file> Record the input lines completed successfully in a checkpoint file
+	-resume        Resume a run, skipping the lines recorded in the checkpoint file and appending to the output file
+	-grace <d>     Time given to the transactions in progress to finish after SIGINT or SIGTERM (Default: 10s)
+	-ctimeout <d>  Maximum time to connect to IMS Connect, including the TLS handshake (Default: 30s)
+	-rtimeout <d>  Maximum time to wait for a response (Default: the -t timeout plus 5 seconds)
+	-reconnect <n> Connection attempts before a worker gives up, reconnecting after errors (Default: 0, no reconnection)
+	-backoff <d>   Delay before the first reconnection or retry, doubled on each attempt (Default: 1s)
+	-maxbackoff <d> Maximum delay between reconnections or retries (Default: 1m)
+	-retry <rules> Send again the transactions answered with some RSM codes: RC[/RSN][:retries],... in hex (like 20:3,8/38)
+	-cm <mode>     Commit mode: 0 (commit-then-send) or 1 (send-then-commit) (Default: 0)
+	-sync <level>  Sync level: none, confirm or syncpt (Default: confirm). Syncpt requires -cm 1 and RRS
+	-nak <mode>    Reject the outputs with a NAK instead of an ACK: none, all or failed (not meeting the expectation) (Default: none)
+	-nakrsn <n>    Reason code sent with the NAKs (Default: 0, none)
+	-send <type>   Message type: sendrec, sendonly, sendonlya (with ACK) or sendonlye (with error return) (Default: sendrec)
+	-ordered       Ordered delivery of the send-only messages (Default: false)
+	-sowait <d>    Time to wait for an error after a sendonlye message (Default: 500ms)
 	-v n           Enable verbose logging (1) or very verbose tracing(2)
 	-h             Show usage help
 
+The TLS options are:
+
+	-tls              Connect to IMS Connect using TLS (Default: false)
+	-tlsca <file>     PEM file with the CA certificates to verify IMS Connect (Default: system pool)
+	-tlscert <file>   PEM file with the client certificate, for client authentication
+	-tlskey <file>    PEM file with the client certificate key, for client authentication
+	-tlsname <name>   Server name used to verify the IMS Connect certificate (Default: <host>)
+	-tlsmin <version> Minimum TLS version: 1.0, 1.1, 1.2 or 1.3 (Default: 1.2)
+
 The tool opens a persistent socket to the IMS systemn and sends the transactions read from the file in sequence.
-It waits for the responses and saves them in the output file. If <concurrent> is greater than 1, it starts
+It waits for the responses and saves them in the output file. At the end of the run, it shows the
+latency statistics (overall and by transaction code) and the throughput. If a load profile (-ramp or -stages)
+is used, the statistics are also shown for each stage. If <concurrent> is greater than 1, it starts
 goroutines to send the transactions concurrently. The transactions are picked from the input file using
 a round-robin algorithm, and the responses are saved in the output file in the order the responses are received. Notice
 the order could be different from the order of the input transactions if the transactions are sent concurrently.
+
+The steps of a conversation (between <conv> and </conv> lines, or in the "conversation" array of a jsonl line) are
+sent in sequence by the same goroutine through its socket, so the IMS conversational transactions keep their SPA.
+The conversation is deallocated after its last step, or after the first step without a response, and its results are
+written together.
+
+The serve command starts a simulated IMS Connect port, to test the injector without an IMS system.
+See serve.go for its options.
+
+The compare command compares the result files of two runs and reports the responses added,
+removed or changed. See compare_cmd.go for its options.
+
+The resume command retrieves the asynchronous output queued to a TPIPE with RESUME TPIPE
+requests. See resume_cmd.go for its options.
+
+The callout command answers the synchronous callout requests of the ICAL calls, acting as
+the external server. See callout_cmd.go for its options.
 */
 func main() {
 	numtransactions := 0
 	numOK := 0
 	numKO := 0
+	numPassed := 0 // Transactions meeting their expectation
+	numFailed := 0 // Transactions with an expectation not met
+	numWorkerErrors := 0
+	numNaked := 0         // Outputs rejected with a NAK
+	numSendOnly := 0      // Send-only messages, without response
+	numDeallocErrors := 0 // Conversations not deallocated
 
 	logf := log.TextFormatter{
 		PadLevelText:           true,
@@ -58,6 +136,23 @@ func main() {
 	// log.SetReportCaller(true)
 	log.Info("Welcome to the IMS Injector!")
 
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		compareResults(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "resume" {
+		resumeTPIPE(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "callout" {
+		calloutResponder(os.Args[2:])
+		return
+	}
+
 	// Command line arguments parsing
 	host := flag.String("i", "", "IMS system `hostname` or IP address (required)")
 	port := flag.Int("p", 4200, "IMS system `port` number")
@@ -68,14 +163,52 @@ func main() {
 	clientID := flag.String("c", "        ", "`ClientID` for the connection (default: generated by IMS system)")
 	lterm := flag.String("l", "INJECTOR", "Logical terminal name (`lterm`) for the connection")
 	concurrent := flag.Int("k", 1, "Number of concurrent transactions to send")
+	format := flag.String("f", FORMAT_TEXT, "Output file `format`: text (<resp>...</resp>) or jsonl (one JSON object per transaction)")
+	inFormat := flag.String("if", FORMAT_TEXT, "Input file `format`: text (one transaction per line) or jsonl (one JSON object per transaction)")
+	separator := flag.String("s", "", "Segment `separator` for multi-segment messages in text input files (default: none)")
+	expand := flag.Bool("T", false, "Expand the %...% placeholders of the messages")
+	vars := make(variables)
+	flag.Var(vars, "D", "Define a `NAME=value` variable for the placeholders (can be repeated, implies -T)")
+	envFile := flag.String("env", "", "`File` with NAME=value variables for the placeholders (implies -T)")
+	seed := flag.Uint64("seed", 0, "`Seed` for the random placeholders (default: 0, random)")
+	rate := flag.Float64("rate", 0, "Send the transactions at a fixed `rate` in transactions per second (default: 0, as fast as possible)")
+	duration := flag.Duration("duration", 0, "Run for a fixed `time` (like 90s or 10m), reading the input file again when its end is reached")
+	iterations := flag.Int("n", 0, "Number of `times` the input file is read (default: 1, or unlimited if -duration, -ramp or -stages are specified)")
+	ramp := flag.String("ramp", "", "Ramp the workers up from 1 to -k, hold and ramp them down, using the `up,hold,down` durations (like 1m,5m,30s)")
+	stages := flag.String("stages", "", "Run `stages` of workers:duration (like 5:2m,20:5m,50:5m) instead of a fixed number of workers")
+	reconnect := flag.Int("reconnect", 0, "Connection `attempts` before a worker gives up, reconnecting after connection errors (default: 0, no reconnection)")
+	backoff := flag.Duration("backoff", time.Second, "`Delay` before the first reconnection or retry, doubled on each attempt")
+	maxBackoff := flag.Duration("maxbackoff", time.Minute, "Maximum `delay` between reconnections or retries")
+	retryRules := flag.String("retry", "", "Send again the transactions answered with an RSM matching the `rules` RC[/RSN][:retries],... in hexadecimal (like 20:3,8/38)")
+	commitMode := flag.String("cm", "0", "Commit `mode`: 0 (commit-then-send) or 1 (send-then-commit)")
+	syncLevel := flag.String("sync", "confirm", "Sync `level`: none, confirm or syncpt (syncpt requires -cm 1 and RRS)")
+	nakMode := flag.String("nak", irm_net.NAK_NONE, "Reject the outputs with a NAK: none, all or failed (not meeting the expectation)")
+	nakReason := flag.Int("nakrsn", 0, "NAK reason `code` (default: 0, none)")
+	sendMode := flag.String("send", "sendrec", "Message `type`: sendrec, sendonly, sendonlya (with ACK) or sendonlye (with error return)")
+	ordered := flag.Bool("ordered", false, "Ordered delivery of the send-only messages")
+	sendOnlyWait := flag.Duration("sowait", imsconnect.DEFAULT_SENDONLY_WAIT, "`Time` to wait for an error after a sendonlye message")
+	junitFile := flag.String("junit", "", "Write a JUnit XML report `file`, with a test case for each transaction")
+	checkpointFile := flag.String("checkpoint", "", "Record the transactions completed successfully in a checkpoint `file`")
+	resume := flag.Bool("resume", false, "Resume an interrupted run, skipping the transactions recorded in the -checkpoint file and appending to the output file")
+	grace := flag.Duration("grace", 10*time.Second, "`Time` given to the transactions in progress to finish after SIGINT or SIGTERM")
+	connectTimeout := flag.Duration("ctimeout", 30*time.Second, "Maximum `time` to connect to IMS Connect, including the TLS handshake (0: no limit)")
+	responseTimeout := flag.Duration("rtimeout", 0, "Maximum `time` to wait for a response (default: the -t timeout plus 5 seconds)")
+	ccsid := flag.String("e", "", "Convert messages to and from the EBCDIC `ccsid` (037, 1140, 1047, 284, 500...) instead of relying on IMS Connect")
 	verbose := flag.Int("v", 0, "Enable verbose logging")
 	help := flag.Bool("h", false, "Show help text")
+	useTLS := flag.Bool("tls", false, "Connect to IMS Connect using TLS")
+	tlsCA := flag.String("tlsca", "", "PEM `file` with the CA certificates used to verify IMS Connect (default: system pool)")
+	tlsCert := flag.String("tlscert", "", "PEM `file` with the client certificate (for client authentication)")
+	tlsKey := flag.String("tlskey", "", "PEM `file` with the client certificate key (for client authentication)")
+	tlsName := flag.String("tlsname", "", "Server `name` used to verify the IMS Connect certificate (default: host name)")
+	tlsMin := flag.String("tlsmin", "1.2", "Minimum TLS `version` (1.0, 1.1, 1.2 or 1.3)")
 
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s: {options} input_file output_file\n", os.Args[0])
-		fmt.Fprintln(w, "The input file must contain an IMS transaction in each line. Blank lines and lines starting with an asterisk are ignored.")
-		fmt.Fprintln(w, "The transaction output will be written into the output file, tagged with <resp>...</resp>")
+		fmt.Fprintln(w, "The input file must contain an IMS transaction in each line, as plain text or as a JSON object (-if jsonl). Blank lines and lines starting with an asterisk are ignored.")
+		fmt.Fprintln(w, "The steps of a conversational transaction are written between <conv> and </conv> lines, or in the \"conversation\" array of a JSON object.")
+		fmt.Fprintln(w, "The transaction output will be written into the output file, tagged with <resp>...</resp> or as JSON lines (-f jsonl)")
 		fmt.Fprintln(w, "The available options are:")
 		flag.PrintDefaults()
 	}
@@ -94,21 +227,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	switch *verbose {
-	case 0:
-		break
-	case 1:
-		{
-			log.SetLevel(log.DebugLevel)
-			log.Info("Verbose logging enabled")
-		}
-	case 2:
-		{
-			log.SetLevel(log.TraceLevel)
-			log.Info("Trace logging enabled")
-
-		}
-	}
+	setVerbosity(*verbose)
 
 	if *host == "" {
 		log.Fatal("Host name or IP address is required")
@@ -140,6 +259,31 @@ func main() {
 		parseError = true
 	}
 
+	var prof profile
+	if *ramp != "" && *stages != "" {
+		log.Fatal("The -ramp and -stages options are mutually exclusive")
+		parseError = true
+	} else if *ramp != "" {
+		prof, err = rampProfile(*ramp, *concurrent)
+	} else if *stages != "" {
+		prof, err = parseStages(*stages)
+	}
+	if err != nil {
+		log.Fatalf("Invalid load profile: %v", err)
+		parseError = true
+	}
+	if prof != nil {
+		if *duration > 0 {
+			log.Fatal("The -duration option can not be used with a load profile, the duration is given by the stages")
+			parseError = true
+		}
+		if prof.maxWorkers() > 99 {
+			log.Fatal("The stages can not use more than 99 workers")
+			parseError = true
+		}
+		*concurrent = prof.maxWorkers()
+	}
+
 	if strings.TrimSpace(*clientID) != "" && *concurrent > 1 {
 		trClientId := strings.TrimSpace(*clientID)
 		var maxlen int
@@ -153,6 +297,102 @@ func main() {
 		}
 	}
 
+	var tlsConfig *tls.Config
+	if *useTLS {
+		tlsConfig, err = imsconnect.NewTLSConfig(*tlsCA, *tlsCert, *tlsKey, *tlsName, *tlsMin)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+			parseError = true
+		}
+	} else if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" || *tlsName != "" {
+		log.Warn("TLS options specified without -tls, they will be ignored")
+	}
+
+	var cp *imsconnect.Codepage
+	if *ccsid != "" {
+		cp, err = imsconnect.LookupCodepage(*ccsid)
+		if err != nil {
+			log.Fatalf("Invalid CCSID: %v", err)
+			parseError = true
+		}
+	}
+
+	if *rate < 0 {
+		log.Fatal("The transaction rate can not be negative")
+		parseError = true
+	}
+
+	if *duration < 0 || *iterations < 0 {
+		log.Fatal("The run duration and the number of iterations can not be negative")
+		parseError = true
+	}
+
+	var policy *imsconnect.RetryPolicy
+	if *connectTimeout < 0 || *responseTimeout < 0 {
+		log.Fatal("The connection and response timeouts can not be negative")
+		parseError = true
+	}
+
+	if *reconnect < 0 || *backoff < 0 || *maxBackoff < 0 {
+		log.Fatal("The reconnection attempts and the backoff delays can not be negative")
+		parseError = true
+	}
+	rules, err := imsconnect.ParseRetryRules(*retryRules)
+	if err != nil {
+		log.Fatalf("Invalid retry rules: %v", err)
+		parseError = true
+	}
+	if *reconnect > 1 || len(rules) > 0 {
+		policy = &imsconnect.RetryPolicy{
+			MaxAttempts: *reconnect,
+			Backoff:     *backoff,
+			MaxBackoff:  *maxBackoff,
+			Jitter:      imsconnect.DEFAULT_JITTER,
+			Rules:       rules,
+		}
+	}
+
+	cm, err := imsconnect.ParseCommitMode(*commitMode)
+	if err != nil {
+		log.Fatalf("Invalid commit mode: %v", err)
+		parseError = true
+	}
+	sync, err := imsconnect.ParseSyncLevel(*syncLevel)
+	if err != nil {
+		log.Fatalf("Invalid sync level: %v", err)
+		parseError = true
+	}
+	if sync == imsconnect.SYNC_SYNCPT && cm != imsconnect.CM1 {
+		log.Fatal("The syncpt sync level requires commit mode 1")
+		parseError = true
+	}
+	if !irm_net.ValidNakMode(*nakMode) {
+		log.Fatalf("Invalid NAK mode %s, expected none, all or failed", *nakMode)
+		parseError = true
+	}
+	if *nakReason < 0 || *nakReason > 0xFFFF {
+		log.Fatal("The NAK reason code must be between 0 and 65535")
+		parseError = true
+	}
+	send, err := imsconnect.ParseSendMode(*sendMode)
+	if err != nil {
+		log.Fatalf("Invalid message type: %v", err)
+		parseError = true
+	}
+	if *sendOnlyWait < 0 {
+		log.Fatal("The send-only wait time can not be negative")
+		parseError = true
+	}
+
+	if *iterations == 0 && *duration == 0 && prof == nil {
+		*iterations = 1
+	}
+
+	if *resume && *checkpointFile == "" {
+		log.Fatal("The -resume option requires a -checkpoint file")
+		parseError = true
+	}
+
 	if parseError {
 		flag.Usage()
 		os.Exit(32)
@@ -166,14 +406,41 @@ func main() {
 	log.Debugf("Username  : %s\n", *user)
 	log.Debugf("Timeout   : %d\n", *timeout)
 	log.Debugf("Concurrent: %d\n", *concurrent)
-
-	irm_template := irm.NewIRM()
-	irm_template.Irm_timer = convert_timeout(*timeout)
-	irm_template.Irm_clientid = fmt.Sprintf("%-8s", *clientID)
-	irm_template.Irm_user.Irm_racf_userid = fmt.Sprintf("%-8s", *user)
-	irm_template.Irm_user.Irm_racf_pw = fmt.Sprintf("%-8s", *password)
-	irm_template.Irm_user.Irm_imsdestid = fmt.Sprintf("%-8s", *datastore)
-	irm_template.Irm_user.Irm_lterm = fmt.Sprintf("%-8s", *lterm)
+	log.Debugf("TLS       : %t\n", *useTLS)
+	log.Debugf("CCSID     : %s\n", *ccsid)
+	log.Debugf("Rate      : %g\n", *rate)
+	log.Debugf("Duration  : %v\n", *duration)
+	log.Debugf("Iterations: %d\n", *iterations)
+	log.Debugf("Stages    : %d\n", len(prof))
+	log.Debugf("Reconnect : %d\n", *reconnect)
+	log.Debugf("Retry     : %s\n", *retryRules)
+	log.Debugf("Commit    : %v, sync %v\n", cm, sync)
+	log.Debugf("NAK       : %s\n", *nakMode)
+	log.Debugf("Send mode : %v, ordered %t\n", send, *ordered)
+	log.Debugf("Checkpoint: %s\n", *checkpointFile)
+	log.Debugf("Resume    : %t\n", *resume)
+
+	opts := imsconnect.Options{
+		Host:            *host,
+		Port:            uint16(*port),
+		Datastore:       *datastore,
+		ClientID:        *clientID,
+		User:            *user,
+		Password:        *password,
+		Lterm:           *lterm,
+		Timeout:         convert_timeout(*timeout),
+		TLSConfig:       tlsConfig,
+		Codepage:        cp,
+		Retry:           policy,
+		ConnectTimeout:  *connectTimeout,
+		ResponseTimeout: *responseTimeout,
+		CommitMode:      cm,
+		SyncLevel:       sync,
+		NakReason:       uint16(*nakReason),
+		SendMode:        send,
+		Ordered:         *ordered,
+		SendOnlyWait:    *sendOnlyWait,
+	}
 
 	// Open the input file
 	inputFile, err := os.Open(flag.Arg(0))
@@ -183,109 +450,415 @@ func main() {
 	}
 	defer inputFile.Close()
 
-	// Open the output file
-	outputFile, err := os.Create(flag.Arg(1))
+	var chk *checkpoint
+	if *checkpointFile != "" {
+		chk, err = openCheckpoint(*checkpointFile, *resume)
+		if err != nil {
+			log.Fatalf("Error opening checkpoint: %v", err)
+			os.Exit(32)
+		}
+		defer chk.close()
+	}
+
+	var reader transactionReader
+	reader, err = newCyclingReader(inputFile, *iterations, func(r io.Reader) (transactionReader, error) {
+		return newTransactionReader(*inFormat, r, *separator)
+	})
+	if err != nil {
+		log.Fatalf("Invalid input format: %v", err)
+		os.Exit(32)
+	}
+
+	if *expand || len(vars) > 0 || *envFile != "" {
+		if *envFile != "" {
+			// The variables defined in the command line take precedence
+			fileVars := make(map[string]string)
+			err = templating.LoadEnvFile(*envFile, fileVars)
+			if err != nil {
+				log.Fatalf("Error reading variables: %v", err)
+				os.Exit(32)
+			}
+			for name, value := range fileVars {
+				if _, ok := vars[name]; !ok {
+					vars[name] = value
+				}
+			}
+		}
+		expander, err := templating.NewExpander(vars, *seed)
+		if err != nil {
+			log.Fatalf("Invalid variables: %v", err)
+			os.Exit(32)
+		}
+		reader = &templateReader{reader: reader, expander: expander}
+	}
+	// The transactions completed by the resumed runs are skipped once the cycling reader has
+	// set their iteration, so the run goes on with the iterations not completed yet. Their
+	// placeholders are expanded anyway, so the remaining transactions get the same generated
+	// values (%SEQ% counters, and the random ones with -seed) as in the resumed run.
+	if chk != nil {
+		reader = &skipReader{reader: reader, checkpoint: chk}
+	}
+
+	// Open the output file. When resuming, the new results are appended to it.
+	outputFlags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if *resume {
+		outputFlags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	outputFile, err := os.OpenFile(flag.Arg(1), outputFlags, 0666)
 	if err != nil {
 		log.Fatalf("Error creating output file: %v", err)
 		os.Exit(32)
 	}
 	defer outputFile.Close()
 
-	// Create channels for communication
-	inc := make(chan string)      // Channel for incoming messages
-	outc := make(chan string, 10) // Channel for outgoing messages
-	errc := make(chan error)      // Channel for errors & control
+	output := bufio.NewWriter(outputFile)
+	writer, err := newResultWriter(*format, output)
+	if err != nil {
+		log.Fatalf("Invalid output format: %v", err)
+		os.Exit(32)
+	}
 
-	// Start the interaction goroutines
-	for n := range *concurrent {
-		go irm_net.Do_interaction(n, *host, uint16(*port), *irm_template, inc, outc, errc)
+	// Create channels for communication
+	inc := make(chan irm_net.Transaction) // Channel for incoming messages
+	outc := make(chan irm_net.Result, 10) // Channel for outgoing messages
+	errc := make(chan error, *concurrent) // Channel for goroutine termination
+	fed := make(chan struct{})            // Closed when there are no more messages to send
+	poolDone := make(chan struct{})       // Closed when all the interaction goroutines have ended
+
+	// The interaction goroutines are started and stopped by the worker pool
+	// Cancelling ctx aborts all the workers, even if they are waiting for a response
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// On SIGINT or SIGTERM stop sending transactions and let the workers finish the ones in progress.
+	// They are aborted when the grace period expires or when a second signal is received.
+	interrupted := make(chan struct{})
+	var signalReceived os.Signal
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		signalReceived = <-sigc
+		log.Warnf("%v received, stopping. The transactions in progress have %v to finish (signal again to abort them)", signalReceived, *grace)
+		close(interrupted)
+		select {
+		case <-time.After(*grace):
+			log.Warn("Grace period expired, aborting the transactions in progress")
+		case <-sigc:
+			log.Warn("Aborting the transactions in progress")
+		}
+		cancel()
+	}()
+	pool := newWorkerPool(ctx, *concurrent, func(ctx context.Context, stop <-chan struct{}, n int) {
+		irm_net.Do_interaction(ctx, stop, n, opts, inc, outc, errc)
+	})
+	start := time.Now()
+	var junit *junitReport
+	if *junitFile != "" {
+		junit = newJunitReport(filepath.Base(flag.Arg(0)), start,
+			junitProperty{Name: "host", Value: *host},
+			junitProperty{Name: "port", Value: strconv.Itoa(*port)},
+			junitProperty{Name: "datastore", Value: strings.TrimSpace(*datastore)},
+			junitProperty{Name: "workers", Value: strconv.Itoa(*concurrent)},
+		)
 	}
+	go func() {
+		if prof == nil {
+			pool.resize(*concurrent)
+			pool.wait()
+		} else {
+			runProfile(pool, prof, start, fed)
+		}
+		// Close the output channel to signal the end of responses
+		close(poolDone)
+		close(outc)
+	}()
 
 	// Read messages from the input file and send them to the interaction goroutine
-	scanner := bufio.NewScanner(inputFile)
-
+	pace := newPacer(*rate)
+	var deadline time.Time
+	if *duration > 0 {
+		deadline = start.Add(*duration)
+	} else if prof != nil {
+		deadline = start.Add(prof.duration())
+	}
+	// An input error stops the feeding, and the run ends once the transactions in progress
+	// are completed, so their results are written and recorded before exiting
+	var feedErr error
 	go func() {
-		for scanner.Scan() {
-			msg := scanner.Text()
-			if msg == "" || msg[0:1] == "*" {
-				continue // Skip empty lines and comments
-			}
-			numtransactions++
-			inc <- msg // Send the message to the interaction goroutine
+		// The feeder stops waiting for a worker when the run duration is reached, or when
+		// there are no workers left to take the transaction (end of the profile)
+		var deadlineReached <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			deadlineReached = timer.C
 		}
-		if err := scanner.Err(); err != nil {
-			log.Fatalf("Error reading input file: %v", err)
-			os.Exit(32)
+	feed:
+		for {
+			tran, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Errorf("Error reading input file: %v", err)
+				feedErr = err
+				break
+			}
+			if tran.IsConversation() && send != imsconnect.SEND_RECEIVE {
+				feedErr = fmt.Errorf("line %d: the conversations require send-receive messages (-send sendrec)", tran.Line)
+				log.Errorf("Invalid input file: %v", feedErr)
+				break
+			}
+			if tran.Nak == "" {
+				tran.Nak = strings.ToLower(*nakMode)
+			}
+			for i := range tran.Steps {
+				if tran.Steps[i].Nak == "" {
+					tran.Steps[i].Nak = tran.Nak
+				}
+			}
+			pace.wait()
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				log.Info("Run duration reached")
+				break
+			}
+			select {
+			case inc <- tran: // Send the message to the interaction goroutine
+			case <-interrupted:
+				break feed
+			case <-ctx.Done():
+				break feed
+			case <-deadlineReached:
+				log.Info("Run duration reached")
+				break feed
+			case <-poolDone:
+				break feed
+			}
+			numtransactions += max(len(tran.Steps), 1)
+			pace.sent()
 		}
 		// Close the input channel to signal the end of messages
 		close(inc)
+		close(fed)
 	}()
 
 	ctrl := make(chan struct{})
 
+	collector := stats.NewCollector()
+	stageCollectors := make([]*stats.Collector, len(prof))
+	for i := range stageCollectors {
+		stageCollectors[i] = stats.NewCollector()
+	}
+
 	go func() {
 		// Process the responses from the interaction goroutine
 		bar := progressbar.Default(-1, "Processing IMS transactions") // Create a spinner
 		defer bar.Close()
-		for {
-			select {
-			case resp := <-outc:
-				if resp != "" {
+
+		// The steps of a conversation are accounted for as transactions, and the
+		// conversation is written and recorded as a whole
+		handleResult := func(result irm_net.Result) {
+			steps := result.Steps
+			if len(steps) == 0 {
+				steps = []irm_net.Result{result}
+			}
+			for i := range steps {
+				step := &steps[i]
+				collector.Add(step)
+				if prof != nil {
+					stageCollectors[prof.stageAt(step.Start.Sub(start))].Add(step)
+				}
+				if step.OK() {
 					numOK++
-					// Write the response to the output file
-					_, err := outputFile.WriteString(fmt.Sprintf("<resp>\n%s\n</resp>\n", resp))
-					bar.Add(1)
-					if err != nil {
-						log.Errorf("Error writing response to output file: %v", err)
-						numKO++
-					}
 				} else {
 					numKO++
 				}
+				if step.Nak {
+					numNaked++
+				}
+				if step.SendOnly {
+					numSendOnly++
+				}
+				if step.Transaction.Expect != nil && !step.SendOnly {
+					checkResult(step, &numPassed, &numFailed)
+				}
+				if junit != nil {
+					junit.Add(step)
+				}
+			}
+			if result.Transaction.IsConversation() && result.Err != nil {
+				numDeallocErrors++ // The steps have their own errors
+			}
+			// Write the response to the output file. With a checkpoint, it is flushed before
+			// recording its line, so a resumed run never skips a result that was not written.
+			err := writer.Write(&result)
+			if err == nil && chk != nil {
+				err = output.Flush()
+			}
+			if err != nil {
+				log.Errorf("Error writing response to output file: %v", err)
+				numKO++
+			} else {
+				err = chk.record(&result)
+				if err != nil {
+					log.Errorf("Error writing checkpoint file: %v", err)
+				}
+			}
+			bar.Add(len(steps))
+		}
 
-			case err := <-errc:
-				if err != nil && err != io.EOF {
-					log.Errorf("Error during interaction: %v", err)
-					numKO++
-				} else {
-					// A goroutine ended, subtract from concurrent number
-					*concurrent--
+		logError := func(err error) {
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Errorf("Error during interaction: %v", err)
+				numWorkerErrors++
+				if junit != nil {
+					junit.AddWorkerError(err)
 				}
-				// Exit the loop if there are no more active goroutines
-				if *concurrent == 0 {
+			}
+		}
+
+		// outc is closed once all the goroutines have ended
+		for {
+			select {
+			case result, ok := <-outc:
+				if !ok {
+					for len(errc) > 0 {
+						logError(<-errc)
+					}
 					ctrl <- struct{}{}
 					return
 				}
+				handleResult(result)
+
+			case err := <-errc:
+				logError(err)
 			}
 		}
 	}()
 
-	// Wait for the interaction goroutine to finish
+	// Wait for the interaction goroutines to finish, and for the feeder goroutine, so its
+	// counters can be read
 	<-ctrl
-	// Close the output channel to signal the end of responses
-	close(outc)
+	<-fed
 
-	log.Infof("Injector run finished. %d transactions processed, %d OK, %d KO", numtransactions, numOK, numKO)
+	err = output.Flush()
+	if err == nil {
+		err = outputFile.Close()
+	}
+	if err != nil {
+		log.Errorf("Error writing the output file: %v", err)
+	}
+	if junit != nil {
+		err = junit.writeFile(*junitFile, collector.Elapsed())
+		if err != nil {
+			log.Errorf("Error writing the JUnit report: %v", err)
+		}
+	}
+	if chk != nil {
+		if chk.skipped > 0 {
+			log.Infof("%d transactions skipped, already completed in the resumed runs", chk.skipped)
+		}
+		err = chk.close()
+		if err != nil {
+			log.Errorf("Error writing the checkpoint file: %v", err)
+		}
+	}
+
+	pace.report()
+	select {
+	case <-interrupted:
+		log.Warnf("Injector run interrupted. %d transactions processed, %d OK, %d KO", numtransactions, numOK, numKO)
+		fmt.Printf("*** INTERRUPTED (%v signal): partial results ***\n", signalReceived)
+	default:
+		log.Infof("Injector run finished. %d transactions processed, %d OK, %d KO", numtransactions, numOK, numKO)
+	}
+	if numPassed+numFailed > 0 {
+		fmt.Printf("Expectations: %d passed, %d failed\n", numPassed, numFailed)
+	}
+	if numSendOnly > 0 {
+		log.Infof("%d of them sent as send-only messages, without a response to write", numSendOnly)
+	}
+	if numNaked > 0 {
+		log.Infof("%d outputs rejected with a NAK", numNaked)
+	}
+	if numDeallocErrors > 0 {
+		log.Warnf("%d conversations could not be deallocated", numDeallocErrors)
+	}
+	collector.Report(os.Stdout)
+	for i, s := range prof {
+		fmt.Printf("\n%s: %s\n", s.name, s)
+		stageCollectors[i].Report(os.Stdout)
+	}
 	var returnCode int
-	if numKO > 0 {
-		returnCode = 1
-	} else {
-		returnCode = 0
+	select {
+	case <-interrupted:
+		returnCode = 128 + int(signalReceived.(syscall.Signal)) // Same as the shell: 130 for SIGINT, 143 for SIGTERM
+	default:
+		if feedErr != nil {
+			returnCode = 32
+		} else if numKO > 0 || numFailed > 0 || numWorkerErrors > 0 || numDeallocErrors > 0 {
+			returnCode = 1
+		} else {
+			returnCode = 0
+		}
 	}
 	os.Exit(returnCode)
 }
 
-// convert_timeout converts a timeout value in seconds to the corresponding OTMA value
+// checkResult accounts for the outcome of a transaction with an expectation, printing
+// the failed checks. They are not logged, to keep the diffs readable.
+func checkResult(result *irm_net.Result, passed *int, failed *int) {
+	if result.Passed() {
+		*passed++
+		return
+	}
+	*failed++
+	failures := result.Failures
+	if !result.OK() {
+		reason := "empty response"
+		if result.Err != nil {
+			reason = result.Err.Error()
+		}
+		failures = []string{"no response: " + reason}
+	}
+	where := fmt.Sprintf("line %d", result.Transaction.Line)
+	if result.Transaction.Step > 0 {
+		where = fmt.Sprintf("line %d step %d", result.Transaction.Line, result.Transaction.Step)
+	}
+	for _, failure := range failures {
+		fmt.Printf("FAILED %s (%s): %s\n", where, result.Trancode, failure)
+	}
+}
+
+// setVerbosity sets the logging level corresponding to the -v flag
+func setVerbosity(verbose int) {
+	switch verbose {
+	case 0:
+		break
+	case 1:
+		{
+			log.SetLevel(log.DebugLevel)
+			log.Info("Verbose logging enabled")
+		}
+	case 2:
+		{
+			log.SetLevel(log.TraceLevel)
+			log.Info("Trace logging enabled")
+
+		}
+	}
+}
+
+// convert_timeout converts a timeout value in seconds to the IRM timer interval. The
+// client library encodes it into the corresponding OTMA value.
 //
 // See table 58 in the IMS Communications and Connections
 // (The table 58 is for the IMS14 version)
 //
 // The default value for 0 is 0.5 seconds
-func convert_timeout(timeout int) byte {
+func convert_timeout(timeout int) time.Duration {
 	if timeout == 0 {
-		return 0x1E // Default  = 0.5 seconds
+		return 500 * time.Millisecond // Default  = 0.5 seconds
 	}
-	base_time := byte(0x27)
-	real_time := base_time + byte(timeout)
-	return real_time
+	return time.Duration(timeout) * time.Second
 }
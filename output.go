@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jguillaumes/ims-injector/internal/irm_net"
+)
+
+// Output formats
+const (
+	FORMAT_TEXT  = "text"  // Responses tagged with <resp>...</resp>
+	FORMAT_JSONL = "jsonl" // One JSON object per transaction
+)
+
+// resultWriter writes the transaction results to the output file
+type resultWriter interface {
+	Write(result *irm_net.Result) error
+}
+
+// newResultWriter creates the writer for an output format
+func newResultWriter(format string, w io.Writer) (resultWriter, error) {
+	switch strings.ToLower(format) {
+	case FORMAT_TEXT:
+		return &textWriter{w: w}, nil
+	case FORMAT_JSONL:
+		return &jsonlWriter{enc: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %s", format)
+	}
+}
+
+// textWriter writes the responses tagged with <resp>...</resp>, one segment per line.
+// Failed transactions and send-only messages are not written. The responses of the
+// steps of a conversation are written between <conv> and </conv> lines.
+type textWriter struct {
+	w io.Writer
+}
+
+func (t *textWriter) Write(result *irm_net.Result) error {
+	if !result.Transaction.IsConversation() {
+		return t.write(result)
+	}
+	_, err := fmt.Fprintln(t.w, CONV_BEGIN)
+	for i := 0; err == nil && i < len(result.Steps); i++ {
+		err = t.write(&result.Steps[i])
+	}
+	if err == nil {
+		_, err = fmt.Fprintln(t.w, CONV_END)
+	}
+	return err
+}
+
+// write writes the response of a transaction
+func (t *textWriter) write(result *irm_net.Result) error {
+	if !result.OK() || result.SendOnly {
+		return nil
+	}
+	_, err := fmt.Fprintf(t.w, "<resp>\n%s\n</resp>\n", strings.Join(result.Segments, "\n"))
+	return err
+}
+
+// jsonlWriter writes a JSON object per transaction, including the failed ones. The
+// steps of a conversation are written one after another, with their step number.
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+// jsonRSM is the JSON representation of a request status message
+type jsonRSM struct {
+	Retcode uint32 `json:"retcode"`
+	Rsncode uint32 `json:"rsncode"`
+}
+
+// jsonResult is the JSON representation of a transaction result
+type jsonResult struct {
+	Line         int       `json:"line"`
+	Iteration    int       `json:"iteration"`
+	Conversation int       `json:"conversation,omitempty"` // Input line of the conversation of a step
+	Step         int       `json:"step,omitempty"`         // Position of the step in its conversation
+	Trancode     string    `json:"trancode"`
+	Input        string    `json:"input"`
+	OK           bool      `json:"ok"`
+	Segments     []string  `json:"segments"`
+	Modname      string    `json:"modname,omitempty"`
+	RSM          *jsonRSM  `json:"rsm,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Passed       *bool     `json:"passed,omitempty"`    // Only if the transaction has an expectation
+	Failures     []string  `json:"failures,omitempty"`  // Failed checks of the expectation
+	Nak          bool      `json:"nak,omitempty"`       // The output was rejected with a NAK
+	SendOnly     bool      `json:"send_only,omitempty"` // Sent as send-only, without response
+	Attempts     int       `json:"attempts,omitempty"`  // Only if the transaction was retried
+	ClientId     string    `json:"client_id"`
+	Worker       int       `json:"worker"`
+	Start        time.Time `json:"start"`
+	ElapsedMs    float64   `json:"elapsed_ms"`
+	ConnectMs    float64   `json:"connect_ms,omitempty"`
+	FirstByteMs  float64   `json:"first_byte_ms"`
+	AckMs        float64   `json:"ack_ms,omitempty"`
+}
+
+func (j *jsonlWriter) Write(result *irm_net.Result) error {
+	if !result.Transaction.IsConversation() {
+		return j.write(result)
+	}
+	for i := range result.Steps {
+		err := j.write(&result.Steps[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes the JSON object of a transaction
+func (j *jsonlWriter) write(result *irm_net.Result) error {
+	record := jsonResult{
+		Line:         result.Transaction.Line,
+		Iteration:    result.Transaction.Iteration,
+		Conversation: result.Transaction.Conversation,
+		Step:         result.Transaction.Step,
+		Trancode:     result.Trancode,
+		Input:        result.Transaction.Text,
+		OK:           result.OK(),
+		Segments:     result.Segments,
+		Modname:      result.Modname,
+		Nak:          result.Nak,
+		SendOnly:     result.SendOnly,
+		ClientId:     result.ClientId,
+		Worker:       result.Worker,
+		Start:        result.Start,
+		ElapsedMs:    milliseconds(result.Timing.RoundTrip),
+		ConnectMs:    milliseconds(result.Timing.Connect),
+		FirstByteMs:  milliseconds(result.Timing.FirstByte),
+		AckMs:        milliseconds(result.Timing.Ack),
+	}
+	if record.Segments == nil {
+		record.Segments = []string{}
+	}
+	if result.RSM != nil {
+		record.RSM = &jsonRSM{Retcode: result.RSM.Retcode, Rsncode: result.RSM.Rsncode}
+	}
+	if result.Err != nil {
+		record.Error = result.Err.Error()
+	}
+	if result.Transaction.Expect != nil {
+		passed := result.Passed()
+		record.Passed = &passed
+		record.Failures = result.Failures
+	}
+	if result.Attempts > 1 {
+		record.Attempts = result.Attempts
+	}
+	return j.enc.Encode(record)
+}
+
+// milliseconds converts a duration to milliseconds, keeping the microseconds as decimals
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/jguillaumes/ims-injector/imsconnect"
+	"github.com/jguillaumes/ims-injector/internal/irm_net"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+resume retrieves the asynchronous output queued by OTMA to a TPIPE, like the messages
+inserted by the IMS applications to an alternate PCB, issuing a RESUME TPIPE request.
+Each message is ACKed, which removes it from the queue, or NAKed, which keeps it there,
+and it is written to the output file in the same formats as the transaction responses.
+
+Usage:
+
+	ims-injector resume [options] <output file>
+
+The options are:
+
+	-i <host>      The host name or IP address of the IMS system (No default, required)
+	-p <port>      The port number of the IMS system (Default: 4200)
+	-d <datastore> The datastore name (No default, required)
+	-c <clientid>  The client ID, whose TPIPE is resumed (No default, required)
+	-tpipe <name>  Resume the TPIPE of another client ID (alternate client ID) (Default: the -c one)
+	-u <user>      The user name to connect to the IMS system (required if OTMA security is enabled)
+	-w <password>  The password to connect to the IMS system (required if OTMA security is enabled)
+	-t <timeout>   Time in seconds IMS Connect waits for a message to arrive (Default: 30)
+	-mode <mode>   RESUME TPIPE flavor: single, singlewait, auto or noauto (Default: single)
+	-n <count>     Maximum number of messages to retrieve (Default: 0, no limit)
+	-duration <d>  Stop retrieving messages after this time (Default: 0, no limit)
+	-nak <mode>    ACK the messages (none) or NAK them to keep them in the queue (all) (Default: none)
+	-nakrsn <n>    Reason code sent with the NAKs (Default: 0, none)
+	-f <format>    Output file format: text or jsonl (Default: text)
+	-e <ccsid>     Convert the messages to and from the given EBCDIC CCSID (Default: no conversion)
+	-ctimeout <d>  Maximum time to connect to IMS Connect, including the TLS handshake (Default: 30s)
+	-v n           Enable verbose logging (1) or very verbose tracing(2)
+
+The TLS options (-tls, -tlsca, -tlscert, -tlskey, -tlsname and -tlsmin) are the same as
+for sending transactions. The retrieval ends when there are no more messages, which for
+the auto flavor means no message arrived during the -t timeout, or on SIGINT or SIGTERM.
+A NAK also ends it, since the message would be sent again. The exit code is 0 if the
+messages were retrieved, 1 if the retrieval failed and 32 if it could not be started.
+*/
+func resumeTPIPE(args []string) {
+	flags := flag.NewFlagSet("resume", flag.ExitOnError)
+	conn := addConnectionFlags(flags, "`Time` in seconds IMS Connect waits for a message to arrive")
+	tpipe := flags.String("tpipe", "", "Resume the `TPIPE` of another client ID (default: the -c client ID)")
+	mode := flags.String("mode", "single", "RESUME TPIPE `flavor`: single, singlewait, auto or noauto")
+	maxMessages := flags.Int("n", 0, "Maximum `number` of messages to retrieve (default: 0, no limit)")
+	duration := flags.Duration("duration", 0, "Stop retrieving messages after this `time` (default: 0, no limit)")
+	nakMode := flags.String("nak", irm_net.NAK_NONE, "ACK the messages (none) or NAK them to keep them in the queue (all)")
+	nakReason := flags.Int("nakrsn", 0, "NAK reason `code` (default: 0, none)")
+	format := flags.String("f", FORMAT_TEXT, "Output file `format`: text or jsonl")
+	verbose := flags.Int("v", 0, "Enable verbose logging")
+
+	flags.Usage = func() {
+		w := flags.Output()
+		fmt.Fprintf(w, "Usage of %s resume: {options} output_file\n", os.Args[0])
+		fmt.Fprintln(w, "Retrieves the messages queued to a TPIPE. The available options are:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	setVerbosity(*verbose)
+
+	// The errors end with code 32, as when sending transactions
+	fail := func(format string, args ...any) {
+		log.Errorf(format, args...)
+		os.Exit(32)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(32)
+	}
+	opts, err := conn.options()
+	if err != nil {
+		fail("Invalid options: %v", err)
+	}
+	req := &imsconnect.ResumeRequest{TPIPE: *tpipe, Max: *maxMessages}
+	req.Mode, err = imsconnect.ParseResumeMode(*mode)
+	if err != nil {
+		fail("Invalid options: %v", err)
+	}
+	switch strings.ToLower(*nakMode) {
+	case irm_net.NAK_NONE:
+	case irm_net.NAK_ALL:
+		req.Nak = func(*imsconnect.Response) bool { return true }
+	default:
+		fail("Invalid NAK mode %s, expected none or all", *nakMode)
+	}
+	if *nakReason < 0 || *nakReason > 0xFFFF {
+		fail("The NAK reason code must be between 0 and 65535")
+	}
+	opts.NakReason = uint16(*nakReason)
+	if *maxMessages < 0 || *duration < 0 {
+		fail("The number of messages and the duration can not be negative")
+	}
+	if len(strings.TrimSpace(*tpipe)) > 8 {
+		fail("The TPIPE name %s is longer than 8 characters", *tpipe)
+	}
+
+	outputFile, err := os.Create(flags.Arg(0))
+	if err != nil {
+		fail("Error creating output file: %v", err)
+	}
+	defer outputFile.Close()
+	output := bufio.NewWriter(outputFile)
+	writer, err := newResultWriter(*format, output)
+	if err != nil {
+		fail("Invalid output format: %v", err)
+	}
+
+	client, err := imsconnect.NewClient(opts)
+	if err != nil {
+		fail("Error creating the IMS Connect client: %v", err)
+	}
+	defer client.Close()
+
+	// SIGINT, SIGTERM and the duration end the retrieval, without losing the messages
+	// already retrieved
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		log.Warnf("%v received, stopping", sig)
+		cancel()
+	}()
+
+	numNaked := 0
+	var writeErr error
+	resumed := strings.TrimSpace(*tpipe)
+	if resumed == "" {
+		resumed = client.ClientID()
+	}
+	log.Infof("Resuming TPIPE %s (%v)", resumed, req.Mode)
+	count, err := client.Resume(ctx, req, func(resp *imsconnect.Response) {
+		result := irm_net.Result{
+			Segments: resp.Segments,
+			Modname:  resp.Modname,
+			ClientId: client.ClientID(),
+			Start:    resp.Start,
+			Timing:   resp.Timing,
+			Attempts: resp.Attempts,
+			Nak:      resp.Nak,
+		}
+		result.Transaction.Iteration = 1
+		if resp.Nak {
+			numNaked++
+		}
+		if writeErr == nil {
+			writeErr = writer.Write(&result)
+		}
+	})
+	if writeErr == nil {
+		writeErr = output.Flush()
+	}
+	if writeErr == nil {
+		writeErr = outputFile.Close()
+	}
+	if writeErr != nil {
+		log.Errorf("Error writing the output file: %v", writeErr)
+	}
+	log.Infof("%d messages retrieved from TPIPE %s, %d kept in the queue with a NAK", count, resumed, numNaked)
+	if err != nil {
+		log.Errorf("Error retrieving the messages: %v", err)
+	}
+	if err != nil || writeErr != nil {
+		os.Exit(1)
+	}
+}
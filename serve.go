@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jguillaumes/ims-injector/internal/codepage"
+	"github.com/jguillaumes/ims-injector/internal/simulator"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+serve starts a simulated IMS Connect port, which answers the transactions using the rules
+read from a JSON file. It allows to develop and test transaction files without an IMS system.
+
+Usage:
+
+	ims-injector serve [options]
+
+The options are:
+
+	-a <address>   The address to listen on (Default: all the interfaces)
+	-p <port>      The port number to listen on (Default: 4200)
+	-r <rules>     JSON file with the response rules (Default: echo all the transactions)
+	-e <ccsid>     The EBCDIC CCSID used for EBCDIC requests (Default: 037)
+	-nowait        Allow the clients to ACK with the NOWAIT option (Default: true)
+	-tlscert <file> PEM file with the server certificate. Enables TLS
+	-tlskey <file>  PEM file with the server certificate key
+	-v n           Enable verbose logging (1) or very verbose tracing(2)
+
+The rules file routes transaction codes to responders:
+
+	{
+	  "default": {"type": "echo"},
+	  "transactions": {
+	    "JGPT001": {"type": "static", "segments": ["HELLO", "WORLD"], "modname": "JGPMOD1", "delay": "100ms"},
+	    "UTLT000": {"type": "echo", "delay": "2s"},
+	    "BADTRAN": {"type": "error", "retcode": "0x0C", "reason": "0x08"},
+	    "ASYNCTR": {"type": "static", "segments": ["ASYNC OUTPUT"], "tpipe": "PRINTER1"},
+	    "CALLTR":  {"type": "callout", "tpipe": "HOLDQ1", "timeout": "5s"}
+	  }
+	}
+
+The tpipe of the echo and static rules also gets their output, to be retrieved with the
+resume command. The callout rules send the message as a synchronous callout request to
+their tpipe, to be answered with the callout command, and return its response.
+*/
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	address := flags.String("a", "", "`Address` to listen on (default: all the interfaces)")
+	port := flags.Int("p", 4200, "`Port` number to listen on")
+	rulesFile := flags.String("r", "", "JSON `file` with the response rules (default: echo all the transactions)")
+	ccsid := flags.String("e", "037", "EBCDIC `ccsid` used for EBCDIC requests")
+	nowait := flags.Bool("nowait", true, "Allow the clients to ACK with the NOWAIT option")
+	tlsCert := flags.String("tlscert", "", "PEM `file` with the server certificate (enables TLS)")
+	tlsKey := flags.String("tlskey", "", "PEM `file` with the server certificate key")
+	verbose := flags.Int("v", 0, "Enable verbose logging")
+
+	flags.Usage = func() {
+		w := flags.Output()
+		fmt.Fprintf(w, "Usage of %s serve: {options}\n", os.Args[0])
+		fmt.Fprintln(w, "Starts a simulated IMS Connect port. The available options are:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	setVerbosity(*verbose)
+
+	if *port < 1 || *port > 65535 {
+		log.Fatal("Port number must be between 1 and 65535")
+	}
+
+	rules := simulator.DefaultRules()
+	if *rulesFile != "" {
+		var err error
+		rules, err = simulator.LoadRules(*rulesFile)
+		if err != nil {
+			log.Fatalf("Error loading rules: %v", err)
+		}
+	}
+
+	cp, err := codepage.Lookup(*ccsid)
+	if err != nil {
+		log.Fatalf("Invalid CCSID: %v", err)
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Error loading the server certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	server, err := simulator.NewServer(rules, cp, tlsConfig)
+	if err != nil {
+		log.Fatalf("Error creating the simulator: %v", err)
+	}
+	server.Nowait = *nowait
+
+	err = server.Listen(fmt.Sprintf("%s:%d", *address, *port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("IMS Connect simulator listening on %s", server.Addr())
+
+	err = server.Serve()
+	if err != nil {
+		log.Fatal(err)
+	}
+}